@@ -0,0 +1,111 @@
+package core
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+)
+
+// TransactionProcessor receives the transactions produced by a capture engine
+type TransactionProcessor func(HttpTransaction)
+
+// CaptureStats holds the packets counters of a single capture interface
+type CaptureStats struct {
+	Interface string
+	Captured  uint64 // packets delivered to the capture engine
+	Received  uint64 // packets received by the capture library
+	Dropped   uint64
+	IfDropped uint64
+	Freezes   uint64 // afpacket ring queue freezes
+}
+
+// Sub returns the counters accumulated since the previous stats.
+// A counter that is lower than its previous value was reset, so its current value is used.
+func (s CaptureStats) Sub(previous CaptureStats) CaptureStats {
+	return CaptureStats{
+		Interface: s.Interface,
+		Captured:  counterDelta(s.Captured, previous.Captured),
+		Received:  counterDelta(s.Received, previous.Received),
+		Dropped:   counterDelta(s.Dropped, previous.Dropped),
+		IfDropped: counterDelta(s.IfDropped, previous.IfDropped),
+		Freezes:   counterDelta(s.Freezes, previous.Freezes),
+	}
+}
+
+// Add returns the sum of the counters
+func (s CaptureStats) Add(other CaptureStats) CaptureStats {
+	return CaptureStats{
+		Interface: s.Interface,
+		Captured:  s.Captured + other.Captured,
+		Received:  s.Received + other.Received,
+		Dropped:   s.Dropped + other.Dropped,
+		IfDropped: s.IfDropped + other.IfDropped,
+		Freezes:   s.Freezes + other.Freezes,
+	}
+}
+
+// DropPercent returns the percent of the packets dropped by the capture library and by the interface.
+// The received packets include the packets dropped by the capture library.
+func (s CaptureStats) DropPercent() float64 {
+	total := s.Received + s.IfDropped
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Dropped+s.IfDropped) * 100 / float64(total)
+}
+
+func counterDelta(current uint64, previous uint64) uint64 {
+	if current < previous {
+		return current
+	}
+	return current - previous
+}
+
+// FlushStats counts the in progress data that a capture engine flushed as transactions when it stopped
+type FlushStats struct {
+	Connections int // TCP connections flushed by the httpdump and afpacket engines
+	Requests    int // requests without a response flushed by the tshark engine
+}
+
+// CaptureEngine captures the network traffic, and produces HTTP transactions
+type CaptureEngine interface {
+	// Start the capture, and send the transactions to the processor
+	Start(processor TransactionProcessor) error
+	// Stop the capture, and send the transactions that are still in progress
+	Stop() FlushStats
+	// Stats returns the packets counters of the captured interfaces
+	Stats() []CaptureStats
+	// Done is closed once the capture source is exhausted, e.g. at the end of a pcap file
+	Done() <-chan bool
+}
+
+type CaptureEngineFactory func(logger *logrus.Logger) CaptureEngine
+
+var captureEngines = make(map[string]CaptureEngineFactory)
+
+// RegisterCaptureEngine makes a capture engine available for the capture argument.
+// It should be called from the init function of the capture engine package.
+func RegisterCaptureEngine(name string, factory CaptureEngineFactory) {
+	if _, exists := captureEngines[name]; exists {
+		panic(fmt.Sprintf("capture engine %v registered twice", name))
+	}
+	captureEngines[name] = factory
+}
+
+func CreateCaptureEngine(name string, logger *logrus.Logger) (CaptureEngine, error) {
+	factory, exists := captureEngines[name]
+	if !exists {
+		return nil, fmt.Errorf("capture engine %v is not registered", name)
+	}
+	return factory(logger), nil
+}
+
+func captureEnginesNames() string {
+	var names []string
+	for name := range captureEngines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
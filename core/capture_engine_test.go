@@ -0,0 +1,32 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestCaptureStatsDelta(t *testing.T) {
+	previous := CaptureStats{Interface: "eth0", Captured: 90, Received: 100, Dropped: 5, IfDropped: 1}
+	current := CaptureStats{Interface: "eth0", Captured: 180, Received: 200, Dropped: 15, IfDropped: 1}
+	delta := current.Sub(previous)
+	if delta != (CaptureStats{Interface: "eth0", Captured: 90, Received: 100, Dropped: 10}) {
+		t.Fatalf("wrong delta %+v", delta)
+	}
+	if delta.DropPercent() != 10 {
+		t.Fatalf("wrong drop percent %v", delta.DropPercent())
+	}
+
+	// the counters were reset, e.g. by a capture restart
+	delta = CaptureStats{Received: 50, Dropped: 1}.Sub(previous)
+	if delta.Received != 50 || delta.Dropped != 1 {
+		t.Fatalf("wrong delta after reset %+v", delta)
+	}
+
+	total := delta.Add(CaptureStats{Received: 48, Dropped: 1, IfDropped: 2})
+	if total.Received != 98 || total.Dropped != 2 || total.IfDropped != 2 || total.DropPercent() != 4 {
+		t.Fatalf("wrong total %+v %v", total, total.DropPercent())
+	}
+
+	if (CaptureStats{}).DropPercent() != 0 {
+		t.Fatalf("drop percent of no packets should be 0")
+	}
+}
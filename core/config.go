@@ -22,6 +22,18 @@ type Configuration = struct {
 	RotateFileMaxSize           int
 	RotateFileMaxBackups        int
 	RotateFileMaxAge            int
+	AfpacketBlockSize           int
+	AfpacketBlockCount          int
+	AfpacketFanoutGroup         int
+	AfpacketWorkers             int
+	WebSocketMaxPayload         int
+	DecodedBodyMaxSize          int
+	RequestBodyMaxSize          int
+	ResponseBodyMaxSize         int
+	DropWarningPercent          float64
+	ExporterMaxEntries          int
+	ExporterMaxBytes            int
+	ExporterOverflowPolicy      string
 	SplitByHost                 bool
 	SplitByAppId                bool
 	ActivateHealthMonitor       bool
@@ -30,12 +42,17 @@ type Configuration = struct {
 	AWSDisableSSL               bool
 	UseCloudWatchLoggerHook     bool
 	IgnoreHealthCheck           bool
+	ElideUploadedFiles          bool
 	BPFType                     string
 	Hosts                       string
 	KeepContentTypes            string
 	HarProcessors               string
 	Capture                     string
 	Device                      string
+	PcapFile                    string
+	Decapsulate                 string
+	TLSKeyLog                   string
+	TLSHosts                    string
 	OutputFolder                string
 	LogSnapshotFile             string
 	SitesStatsFile              string
@@ -61,6 +78,7 @@ type Configuration = struct {
 	FullChannelCheckInterval    time.Duration
 	FullChannelTimeout          time.Duration
 	HealthTransactionTimeout    time.Duration
+	ShutdownTimeout             time.Duration
 
 }
 
@@ -73,6 +91,17 @@ var supportedProcessors = map[string]bool{
 	"sampled-transactions": true,
 	"s3": true,
 }
+var supportedOverflowPolicies = map[string]bool{
+	"block":       true,
+	"drop-newest": true,
+	"drop-oldest": true,
+	"drop-bodies": true,
+}
+var supportedEncapsulations = map[string]bool{
+	"vlan":  true,
+	"gre":   true,
+	"vxlan": true,
+}
 var args = make([]string,1)
 
 func grabFlagProperties(f *flag.Flag) {
@@ -91,6 +120,18 @@ func Init() {
 	flag.IntVar(&Config.RotateFileMaxAge, "rotate-file-max-age", 100, "max number of days to keep files")
 	flag.IntVar(&Config.LimitedErrorLength, "limited-error-length", 15, "truncate long errors to this length")
 	flag.IntVar(&Config.DumpCapBufferSize, "dumpcap-buffer-size", 20, "capture buffer size (in MiB)")
+	flag.IntVar(&Config.AfpacketBlockSize, "afpacket-block-size", 1024*1024, "afpacket ring block size in bytes, must be a multiple of the page size")
+	flag.IntVar(&Config.AfpacketBlockCount, "afpacket-block-count", 64, "afpacket ring blocks count")
+	flag.IntVar(&Config.AfpacketFanoutGroup, "afpacket-fanout-group", 0, "afpacket fanout group id, use the same id in several processes to share the traffic between them. 0=derive from the process id")
+	flag.IntVar(&Config.AfpacketWorkers, "afpacket-workers", 4, "afpacket sockets in the fanout group, each assembling its flows in parallel")
+	flag.IntVar(&Config.WebSocketMaxPayload, "websocket-max-payload", 1024*1024, "max payload bytes of the messages retained for each WebSocket session. 0=retain the messages without their payload")
+	flag.IntVar(&Config.DecodedBodyMaxSize, "decoded-body-max-size", 10*1024*1024, "max size in bytes of a decompressed body, larger bodies are kept encoded")
+	flag.IntVar(&Config.RequestBodyMaxSize, "request-body-max-size", 0, "max bytes kept of a request body, the rest of the body is discarded while it is read. 0=unlimited")
+	flag.IntVar(&Config.ResponseBodyMaxSize, "response-body-max-size", 0, "max bytes kept of a response body, the rest of the body is discarded while it is read. 0=unlimited")
+	flag.Float64Var(&Config.DropWarningPercent, "drop-warning-percent", 1, "warn when the percent of packets dropped by the capture in a cloud-watch-stats-interval is above this value. 0=never warn")
+	flag.IntVar(&Config.ExporterMaxEntries, "exporter-max-entries", 0, "max transactions held by the exporter until the next export. 0=unlimited")
+	flag.IntVar(&Config.ExporterMaxBytes, "exporter-max-bytes", 0, "max estimated bytes of the transactions held by the exporter until the next export. 0=unlimited")
+	flag.StringVar(&Config.ExporterOverflowPolicy, "exporter-overflow-policy", "drop-bodies", "what to do when the exporter limits are reached: block (wait for the next export, blocking the capture), drop-newest, drop-oldest, or drop-bodies (remove the bodies of the held transactions, oldest first, and then drop the newest)")
 	flag.IntVar(&Config.InstanceId, "instance-id", 0, "when running in a cluster we identify each instance by this id")
 	flag.IntVar(&Config.SampledTransactionsRate, "sample-transactions-rate", 1, "how many transactions should be sampled in each stats interval")
 	flag.IntVar(&Config.ChannelBuffer, "channel-buffer", 1, "channel buffer size")
@@ -107,12 +148,17 @@ func Init() {
 	flag.BoolVar(&Config.S3ExporterShouldCompress, "s3-exporter-compress", true, "compress the HAR before you dump it to s3")
 	flag.BoolVar(&Config.SendSiteStatsToCloudWatch, "send-sites-stats-to-cloudwatch", true, "send site stats stats to AWS CloudWatch")
 	flag.BoolVar(&Config.IgnoreHealthCheck, "ignore-hc", true, "do not dump cwaf HC calls")
+	flag.BoolVar(&Config.ElideUploadedFiles, "elide-uploaded-files", false, "omit the content of the files uploaded by multipart requests from the HAR post data params")
 	flag.StringVar(&Config.BPFType, "bpf-type", "not-strict", "BPF type: strict|not-strict")
 	flag.StringVar(&Config.OutputFolder, "output-folder", ".", "har files output folder")
-	flag.StringVar(&Config.Hosts, "hosts", ":80", "comma separated list of IP:port to sample e.g. 1.1.1.1:80,2.2.2.2:9090. To sample all hosts on port 9090, use :9090")
+	flag.StringVar(&Config.Hosts, "hosts", ":80", "comma separated list of IP:port to sample e.g. 1.1.1.1:80,2.2.2.2:9090,[2001:db8::1]:8080. To sample all hosts on port 9090, use :9090. Supports CIDRs 10.1.0.0/16:80, port ranges :54000-54020 and exclusions !10.1.2.3")
+	flag.StringVar(&Config.TLSHosts, "tls-hosts", "", "comma separated list of IP:port that carry TLS traffic e.g. :443,10.1.1.1:8443. These hosts are captured in addition to the hosts, and decrypted using the tls-keylog")
+	flag.StringVar(&Config.TLSKeyLog, "tls-keylog", "", "NSS key log file (SSLKEYLOGFILE) with the TLS secrets used to decrypt the tls-hosts traffic")
 	flag.StringVar(&Config.KeepContentTypes, "keep-content-type", "json,xml", "comma separated list of content type whose body should be kept (case insensitive, using include for match)")
-	flag.StringVar(&Config.Device, "device", "", "interface to use sniffing for")
-	flag.StringVar(&Config.Capture, "capture", "tshark", "capture engine to use, one of tshark,httpdump")
+	flag.StringVar(&Config.Device, "device", "", "comma separated list of interfaces to use sniffing for, or any to sniff all interfaces")
+	flag.StringVar(&Config.PcapFile, "pcap-file", "", "read packets from a pcap/pcapng file instead of sniffing an interface")
+	flag.StringVar(&Config.Decapsulate, "decapsulate", "vlan,gre,vxlan", "comma separated list of encapsulations to capture and decapsulate by the httpdump and afpacket capture engines: vlan,gre,vxlan. ERSPAN is carried by gre")
+	flag.StringVar(&Config.Capture, "capture", "tshark", "capture engine to use, one of "+captureEnginesNames())
 	flag.StringVar(&Config.LogSnapshotFile, "log-snapshot-file", "snapshot.log", "logs snapshot file name")
 	flag.StringVar(&Config.SitesStatsFile, "sites-stats-file", "statistics.csv", "sites statistics CSV file")
 	flag.StringVar(&Config.RequestsSizesStatsFile, "requests-sizes-stats-file", "requests_sizes.csv", "requests sizes statistics CSV file")
@@ -138,6 +184,7 @@ func Init() {
 	flag.DurationVar(&Config.FullChannelCheckInterval, "full-channel-check-interval", 20*time.Millisecond, "check a full channel interval")
 	flag.DurationVar(&Config.FullChannelTimeout, "full-channel-timeout", 5*time.Second, "abandon a full channel after this time")
 	flag.DurationVar(&Config.HealthTransactionTimeout, "health-transaction-timeout", 10*time.Second, "return error on health if transaction was not received for this period")
+	flag.DurationVar(&Config.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "abandon the flush of the captured transactions on termination after this time")
 
 	flag.Parse()
 	flag.VisitAll(grabFlagProperties)
@@ -152,8 +199,14 @@ func Init() {
 	V5("V5 mode activated")
 	V5("common configuration loaded: %v", string(marshal))
 
-	if Config.Device == "" {
-		fatal("device argument must be supplied")
+	if Config.Device == "" && Config.PcapFile == "" {
+		fatal("device or pcap-file argument must be supplied")
+	}
+	devices := Devices()
+	for _, device := range devices {
+		if device == "any" && len(devices) > 1 {
+			fatal("device any cannot be combined with other devices")
+		}
 	}
 
 	processors := strings.Split(Config.HarProcessors, ",")
@@ -168,8 +221,45 @@ func Init() {
 			fatal("S3 exporter is active and S3 bucket in not defined. Use -s3-bucket-name <my_bucket_name>")
 		}
 	}
-	if Config.Capture != "tshark" && Config.Capture != "httpdump" {
-		fatal("invalid capture specified")
+	if _, exists := captureEngines[Config.Capture]; !exists {
+		fatal("invalid capture specified %v, use one of %v", Config.Capture, captureEnginesNames())
+	}
+	for _, encapsulation := range strings.Split(Config.Decapsulate, ",") {
+		if encapsulation != "" && !supportedEncapsulations[encapsulation] {
+			fatal("invalid encapsulation specified %v", encapsulation)
+		}
+	}
+	if Config.Capture == "afpacket" {
+		if Config.PcapFile != "" {
+			fatal("afpacket capture cannot read a pcap-file")
+		}
+		if Config.AfpacketWorkers < 1 {
+			fatal("afpacket-workers must be at least 1")
+		}
+		if Config.AfpacketFanoutGroup < 0 || Config.AfpacketFanoutGroup > 0xFFFF {
+			fatal("afpacket-fanout-group must be in the range 0-65535")
+		}
+	}
+	if Config.WebSocketMaxPayload < 0 {
+		fatal("websocket-max-payload must not be negative")
+	}
+	if !supportedOverflowPolicies[Config.ExporterOverflowPolicy] {
+		fatal("invalid exporter-overflow-policy specified %v", Config.ExporterOverflowPolicy)
+	}
+	if Config.ExporterMaxEntries < 0 || Config.ExporterMaxBytes < 0 {
+		fatal("exporter-max-entries and exporter-max-bytes must not be negative")
+	}
+	if Config.RequestBodyMaxSize < 0 || Config.ResponseBodyMaxSize < 0 {
+		fatal("request-body-max-size and response-body-max-size must not be negative")
+	}
+	if Config.DropWarningPercent < 0 || Config.DropWarningPercent > 100 {
+		fatal("drop-warning-percent must be in the range 0-100")
+	}
+	if Config.ShutdownTimeout <= 0 {
+		fatal("shutdown-timeout must be positive")
+	}
+	if Config.TLSHosts != "" && Config.TLSKeyLog == "" {
+		fatal("tls-hosts requires the tls-keylog argument")
 	}
 	if Config.Hosts == "" {
 		info("hosts were not supplied, will capture all IPs on port 80")
@@ -177,3 +267,25 @@ func Init() {
 
 	go snapshotTimer()
 }
+
+// Devices returns the list of interfaces to capture from
+func Devices() []string {
+	var devices []string
+	for _, device := range strings.Split(Config.Device, ",") {
+		device = strings.TrimSpace(device)
+		if device != "" {
+			devices = append(devices, device)
+		}
+	}
+	return devices
+}
+
+// IsDecapsulated returns true if the encapsulation should be captured and decapsulated
+func IsDecapsulated(encapsulation string) bool {
+	for _, name := range strings.Split(Config.Decapsulate, ",") {
+		if strings.TrimSpace(name) == encapsulation {
+			return true
+		}
+	}
+	return false
+}
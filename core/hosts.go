@@ -1,13 +1,21 @@
 package core
 
 import (
+	"net"
 	"strconv"
 	"strings"
 )
 
+// Host is a single entry of the hosts argument.
+// The Ip is either an IP or a CIDR, and is empty to match any IP.
+// The ports range is Port to PortEnd, and a zero Port matches any port.
 type Host struct {
-	Ip   string
-	Port int
+	Ip      string
+	Port    int
+	PortEnd int
+	Exclude bool
+	ip      net.IP
+	network *net.IPNet
 }
 
 type Hosts struct {
@@ -15,6 +23,25 @@ type Hosts struct {
 	hosts []Host
 }
 
+// CapturedHosts returns the hosts that should be captured: the plain HTTP hosts, and the TLS hosts
+func CapturedHosts() *Hosts {
+	if Config.TLSHosts == "" {
+		return ProduceHosts(Config.Hosts)
+	}
+	if Config.Hosts == "" {
+		return ProduceHosts(Config.TLSHosts)
+	}
+	return ProduceHosts(Config.Hosts + "," + Config.TLSHosts)
+}
+
+// TLSHosts returns the hosts whose traffic should be decrypted, or nil in case TLS decryption is not configured
+func TLSHosts() *Hosts {
+	if Config.TLSHosts == "" {
+		return nil
+	}
+	return ProduceHosts(Config.TLSHosts)
+}
+
 func ProduceHosts(arg string) *Hosts {
 	h := Hosts{}
 	h.init(arg)
@@ -26,31 +53,201 @@ func (h *Hosts) init(arg string) {
 
 	sections := strings.Split(arg, ",")
 	for i := 0; i < len(sections); i++ {
-		h.hosts = append(h.hosts, h.getHost(sections[i]))
+		h.hosts = h.merge(h.hosts, h.getHost(strings.TrimSpace(sections[i])))
 	}
 
 }
 
+// getHost parses a single host argument: IP:port, :port, IP, or a bracketed IPv6 [IP]:port.
+// The IP can be a CIDR, the port can be a range from-to, and a ! prefix excludes the host.
 func (h *Hosts) getHost(arg string) Host {
+	var host Host
+	if strings.HasPrefix(arg, "!") {
+		host.Exclude = true
+		arg = arg[1:]
+	}
+
+	ip, portText := splitHostPort(arg)
+	host.Ip = ip
+	if strings.Contains(ip, "/") {
+		_, network, err := net.ParseCIDR(ip)
+		if err != nil {
+			fatal("parse CIDR in %v failed: %v", arg, err)
+		}
+		host.network = network
+	} else if ip != "" {
+		host.ip = net.ParseIP(ip)
+		if host.ip == nil && strings.Contains(ip, ":") {
+			fatal("parse IPv6 address in %v failed", arg)
+		}
+	}
+
+	// an excluded IP without a port is excluded on all ports
+	if portText == "" {
+		if !host.Exclude {
+			host.Port = 80
+			host.PortEnd = 80
+		}
+		return host
+	}
+
+	host.Port, host.PortEnd = parsePorts(arg, portText)
+	return host
+}
+
+func splitHostPort(arg string) (string, string) {
+	if strings.HasPrefix(arg, "[") {
+		end := strings.Index(arg, "]")
+		if end == -1 {
+			fatal("missing closing bracket in %v", arg)
+		}
+		rest := arg[end+1:]
+		if rest != "" && !strings.HasPrefix(rest, ":") {
+			fatal("invalid port section in %v", arg)
+		}
+		return arg[1:end], strings.TrimPrefix(rest, ":")
+	}
+
+	// an IPv6 address without brackets has no port
+	if strings.Count(arg, ":") > 1 {
+		return arg, ""
+	}
+
 	sections := strings.Split(arg, ":")
 	if len(sections) == 1 {
-		return Host{
-			Ip:   arg,
-			Port: 80,
-		}
+		return arg, ""
+	}
+	return sections[0], sections[1]
+}
+
+func parsePorts(arg string, portText string) (int, int) {
+	sections := strings.Split(portText, "-")
+	if len(sections) > 2 {
+		fatal("invalid ports range in %v", arg)
 	}
 
-	port, err := strconv.Atoi(sections[1])
+	from, err := strconv.Atoi(sections[0])
 	if err != nil {
 		fatal("parse port in %v failed: %v", arg, err)
 	}
+	to := from
+	if len(sections) == 2 {
+		to, err = strconv.Atoi(sections[1])
+		if err != nil {
+			fatal("parse port in %v failed: %v", arg, err)
+		}
+	}
 
-	return Host{
-		Ip:   sections[0],
-		Port: port,
+	if from < 1 || to > 65535 || from > to {
+		fatal("invalid ports range in %v", arg)
 	}
+	return from, to
+}
+
+// merge the host into an existing host with the same IP, in case their ports ranges overlap or are adjacent,
+// so the filters list consecutive ports as a single range
+func (h *Hosts) merge(hosts []Host, host Host) []Host {
+	for i := range hosts {
+		existing := &hosts[i]
+		if existing.Ip != host.Ip || existing.Exclude != host.Exclude {
+			continue
+		}
+		if existing.Port == 0 || host.Port == 0 {
+			existing.Port = 0
+			existing.PortEnd = 0
+			return hosts
+		}
+		if host.Port <= existing.PortEnd+1 && host.PortEnd >= existing.Port-1 {
+			merged := *existing
+			if host.Port < merged.Port {
+				merged.Port = host.Port
+			}
+			if host.PortEnd > merged.PortEnd {
+				merged.PortEnd = host.PortEnd
+			}
+			// the merged range might now be adjacent to another range of the same IP
+			return h.merge(append(hosts[:i], hosts[i+1:]...), merged)
+		}
+	}
+	return append(hosts, host)
+}
+
+// IsIPv6 returns true if the host IP is an IPv6 address or network
+func (h Host) IsIPv6() bool {
+	return strings.Contains(h.Ip, ":")
+}
+
+// IsNetwork returns true if the host IP is a CIDR
+func (h Host) IsNetwork() bool {
+	return h.network != nil
+}
+
+// IsPortRange returns true if the host matches more than a single port
+func (h Host) IsPortRange() bool {
+	return h.PortEnd > h.Port
+}
+
+func (h Host) match(ip net.IP, ipText string, port int) bool {
+	if h.Port != 0 && (port < h.Port || port > h.PortEnd) {
+		return false
+	}
+
+	if h.Ip == "" {
+		return true
+	}
+	if h.network != nil {
+		return ip != nil && h.network.Contains(ip)
+	}
+	if h.ip != nil {
+		return ip != nil && h.ip.Equal(ip)
+	}
+	return h.Ip == ipText
 }
 
 func (h *Hosts) GetHosts() []Host {
 	return h.hosts
 }
+
+// GetIncluded returns the hosts that should be captured
+func (h *Hosts) GetIncluded() []Host {
+	var hosts []Host
+	for _, host := range h.hosts {
+		if !host.Exclude {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// GetExcluded returns the hosts that should not be captured, even if they are included
+func (h *Hosts) GetExcluded() []Host {
+	var hosts []Host
+	for _, host := range h.hosts {
+		if host.Exclude {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// Match returns true if the IP and port are included in the hosts, and are not excluded.
+// In case only exclusions are specified, any other IP and port is included.
+func (h *Hosts) Match(ipText string, port int) bool {
+	ip := net.ParseIP(ipText)
+	included := false
+	hasIncluded := false
+	for _, host := range h.hosts {
+		if host.Exclude {
+			if host.match(ip, ipText, port) {
+				return false
+			}
+			continue
+		}
+
+		hasIncluded = true
+		if !included && host.match(ip, ipText, port) {
+			included = true
+		}
+	}
+	return included || !hasIncluded
+}
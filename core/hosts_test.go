@@ -0,0 +1,67 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestHostsParse(t *testing.T) {
+	hosts := ProduceHosts("1.1.1.1:80,10.1.0.0/16:8080,:54000-54020,[2001:db8::1]:443,!10.1.2.3").GetHosts()
+	if len(hosts) != 5 {
+		t.Fatalf("expected 5 hosts, but got %+v", hosts)
+	}
+	if hosts[1].Ip != "10.1.0.0/16" || !hosts[1].IsNetwork() || hosts[1].Port != 8080 {
+		t.Fatalf("wrong CIDR host %+v", hosts[1])
+	}
+	if hosts[2].Ip != "" || hosts[2].Port != 54000 || hosts[2].PortEnd != 54020 {
+		t.Fatalf("wrong ports range host %+v", hosts[2])
+	}
+	if hosts[3].Ip != "2001:db8::1" || !hosts[3].IsIPv6() || hosts[3].Port != 443 {
+		t.Fatalf("wrong IPv6 host %+v", hosts[3])
+	}
+	if !hosts[4].Exclude || hosts[4].Ip != "10.1.2.3" || hosts[4].Port != 0 {
+		t.Fatalf("wrong excluded host %+v", hosts[4])
+	}
+}
+
+func TestHostsMergePorts(t *testing.T) {
+	hosts := ProduceHosts(":54004,:54006,:54005,:54010-54020,:54021").GetHosts()
+	if len(hosts) != 2 {
+		t.Fatalf("expected 2 hosts, but got %+v", hosts)
+	}
+	if hosts[0].Port != 54004 || hosts[0].PortEnd != 54006 {
+		t.Fatalf("wrong first range %+v", hosts[0])
+	}
+	if hosts[1].Port != 54010 || hosts[1].PortEnd != 54021 {
+		t.Fatalf("wrong second range %+v", hosts[1])
+	}
+}
+
+func TestHostsMatch(t *testing.T) {
+	hosts := ProduceHosts("10.1.0.0/16:80,:54000-54020,[2001:db8::1]:8080,!10.1.2.3")
+	checks := []struct {
+		ip       string
+		port     int
+		expected bool
+	}{
+		{"10.1.5.5", 80, true},
+		{"10.1.5.5", 81, false},
+		{"10.2.5.5", 80, false},
+		{"10.1.2.3", 80, false},
+		{"10.1.2.3", 54010, false},
+		{"192.168.1.1", 54010, true},
+		{"192.168.1.1", 54021, false},
+		{"2001:db8::1", 8080, true},
+		{"2001:db8:0::1", 8080, true},
+		{"2001:db8::2", 8080, false},
+	}
+	for _, check := range checks {
+		if hosts.Match(check.ip, check.port) != check.expected {
+			t.Fatalf("match %v:%v expected %v", check.ip, check.port, check.expected)
+		}
+	}
+
+	onlyExcluded := ProduceHosts("!10.1.2.3")
+	if !onlyExcluded.Match("10.1.2.4", 80) || onlyExcluded.Match("10.1.2.3", 443) {
+		t.Fatalf("wrong match when only exclusions are specified")
+	}
+}
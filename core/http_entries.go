@@ -2,17 +2,53 @@ package core
 
 import "time"
 
+// HttpEntry is a request or a response.
+// Time is the capture time of the first byte, and EndTime is the capture time of the last byte,
+// EndTime is nil when only a single time is known.
+// Frame is the capture frame number, and PairedFrame is the frame of the matching response or request,
+// as reported by tshark. Both are 0 when unknown.
+// Data is truncated to the configured max body size, and Truncated is set in this case.
+// OriginalSize is the size of the body as it was sent, 0 when it is the data length.
 type HttpEntry struct {
-	Time    *time.Time
-	Stream  int
-	Data    string
-	Version string
-	Headers []string
+	Time         *time.Time
+	EndTime      *time.Time
+	Stream       int
+	Frame        int
+	PairedFrame  int
+	Data         string
+	OriginalSize int
+	Truncated    bool
+	Version      string
+	Headers      []string
 }
 
+// BodySize returns the size of the body as it was sent, which is above the data length when the body was truncated
+func (e HttpEntry) BodySize() int {
+	if e.OriginalSize > 0 {
+		return e.OriginalSize
+	}
+	return len(e.Data)
+}
+
+// TruncateBody keeps the first max size bytes of the data. A max size of 0 keeps the whole data.
+func (e *HttpEntry) TruncateBody(maxSize int) {
+	if maxSize <= 0 || len(e.Data) <= maxSize {
+		return
+	}
+	e.OriginalSize = e.BodySize()
+	// copy the kept bytes, so the memory of the whole body is released
+	e.Data = string([]byte(e.Data[:maxSize]))
+	e.Truncated = true
+}
+
+// HttpIpAndPort holds the client and server endpoints of the connection that carried the transaction.
+// ConnectionID identifies the connection: the tshark TCP stream number, or the httpdump flow.
 type HttpIpAndPort struct {
-	DstIP       string
-	DstPort     int
+	SrcIP        string
+	SrcPort      int
+	DstIP        string
+	DstPort      int
+	ConnectionID string
 }
 
 type HttpRequest struct {
@@ -23,12 +59,50 @@ type HttpRequest struct {
 	HttpIpAndPort HttpIpAndPort
 }
 
+// HttpResponse is a captured response.
+// StatusText is the reason phrase of the status line, empty when it was not captured, e.g. for HTTP/2.
 type HttpResponse struct {
 	HttpEntry
-	Code int
+	Code       int
+	StatusText string
+}
+
+// HttpTunnel holds the outer encapsulation of a transaction captured from a tunnel or a tagged port.
+// Encapsulation lists the tunnel layers, outer first, e.g. vlan,gre,erspan.
+type HttpTunnel struct {
+	Encapsulation []string
+	VlanID        int
+	VNI           int
+	GreKey        int
+	ErspanSession int
+}
+
+// HttpWebSocketMessage is a message sent over a connection upgraded to WebSocket.
+// Type is send for a client message, and receive for a server message.
+// Binary payloads are base64 encoded.
+type HttpWebSocketMessage struct {
+	Type   string
+	Time   time.Time
+	Opcode int
+	Data   string
+}
+
+// HttpTcpMetrics are the TCP quality metrics of the connection that carried the transaction.
+// The counters are the events since the previous transaction of the connection,
+// and HandshakeRTT is the time from the client SYN to the client ACK of the handshake,
+// set only for the first transaction of the connection, and 0 when the handshake was not captured.
+type HttpTcpMetrics struct {
+	Retransmissions int
+	OutOfOrder      int
+	ZeroWindows     int
+	HandshakeRTT    time.Duration
 }
 
 type HttpTransaction struct {
-	Request  HttpRequest
-	Response *HttpResponse
+	Request           HttpRequest
+	Response          *HttpResponse
+	Tunnel            *HttpTunnel
+	WebSocketMessages []HttpWebSocketMessage
+	TcpMetrics        *HttpTcpMetrics
+	BodiesDropped     bool // the bodies were removed by the exporter to limit its memory
 }
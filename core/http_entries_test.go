@@ -0,0 +1,22 @@
+package core
+
+import "testing"
+
+func TestTruncateBody(t *testing.T) {
+	entry := HttpEntry{Data: "0123456789"}
+	entry.TruncateBody(0)
+	if entry.Data != "0123456789" || entry.Truncated || entry.BodySize() != 10 {
+		t.Fatalf("unlimited body should not be truncated %+v", entry)
+	}
+
+	entry.TruncateBody(4)
+	if entry.Data != "0123" || !entry.Truncated || entry.BodySize() != 10 {
+		t.Fatalf("wrong truncated body %+v", entry)
+	}
+
+	// a second truncation keeps the size of the body as it was sent
+	entry.TruncateBody(2)
+	if entry.Data != "01" || entry.BodySize() != 10 {
+		t.Fatalf("wrong truncated body %+v", entry)
+	}
+}
@@ -0,0 +1,174 @@
+package exporters
+
+import (
+	"fmt"
+	"github.com/alonana/httshark/core"
+)
+
+const overflowBlock = "block"
+const overflowDropNewest = "drop-newest"
+const overflowDropOldest = "drop-oldest"
+const overflowDropBodies = "drop-bodies"
+
+// DropCounters counts the decisions of the exporter overflow policy
+type DropCounters struct {
+	DroppedNewest uint64 // transactions dropped on arrival
+	DroppedOldest uint64 // held transactions dropped to make room for new ones
+	DroppedBodies uint64 // transactions whose bodies were removed
+	Blocked       uint64 // transactions that waited for the next export
+}
+
+func (c DropCounters) sub(previous DropCounters) DropCounters {
+	return DropCounters{
+		DroppedNewest: c.DroppedNewest - previous.DroppedNewest,
+		DroppedOldest: c.DroppedOldest - previous.DroppedOldest,
+		DroppedBodies: c.DroppedBodies - previous.DroppedBodies,
+		Blocked:       c.Blocked - previous.Blocked,
+	}
+}
+
+func (c DropCounters) String() string {
+	return fmt.Sprintf("dropped newest: %v, dropped oldest: %v, dropped bodies: %v, blocked: %v",
+		c.DroppedNewest, c.DroppedOldest, c.DroppedBodies, c.Blocked)
+}
+
+// DropCounters returns the counters of the overflow policy decisions since the processor start
+func (p *Processor) DropCounters() DropCounters {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.drops
+}
+
+// logDrops logs the overflow policy decisions since the previous export
+func (p *Processor) logDrops() {
+	drops := p.DropCounters()
+	delta := drops.sub(p.reportedDrops)
+	p.reportedDrops = drops
+	if delta != (DropCounters{}) {
+		p.Logger.Warn(fmt.Sprintf("exporter limits reached, using the %v policy. %v", core.Config.ExporterOverflowPolicy, delta))
+	}
+}
+
+// add the transaction to the held transactions, using the overflow policy when the limits are reached.
+// The mutex must be held by the caller.
+func (p *Processor) add(transaction core.HttpTransaction) {
+	size := transactionSize(transaction)
+	switch core.Config.ExporterOverflowPolicy {
+	case overflowBlock:
+		// a transaction above the limits is added once the held transactions are exported
+		if !p.fits(size) && len(p.transactions) > 0 && !p.closing {
+			p.drops.Blocked++
+			for !p.fits(size) && len(p.transactions) > 0 && !p.closing {
+				p.space.Wait()
+			}
+		}
+		p.append(transaction, size)
+		return
+	case overflowDropNewest:
+		// the new transaction is dropped below
+	case overflowDropOldest:
+		for !p.fits(size) && len(p.transactions) > 0 {
+			p.heldBytes -= transactionSize(p.transactions[0])
+			p.transactions[0] = core.HttpTransaction{}
+			p.transactions = p.transactions[1:]
+			p.drops.DroppedOldest++
+		}
+	case overflowDropBodies:
+		// dropping the bodies does not help when the entries limit is reached
+		if p.entriesFull() {
+			break
+		}
+		for !p.fits(size) && p.withoutBodies < len(p.transactions) {
+			p.heldBytes += p.dropBodies(&p.transactions[p.withoutBodies])
+			p.withoutBodies++
+		}
+		if !p.fits(size) {
+			size += p.dropBodies(&transaction)
+		}
+	}
+
+	if !p.fits(size) {
+		p.drops.DroppedNewest++
+		return
+	}
+	p.append(transaction, size)
+}
+
+func (p *Processor) append(transaction core.HttpTransaction, size int) {
+	p.transactions = append(p.transactions, transaction)
+	p.heldBytes += size
+}
+
+// fits returns whether a transaction of the size can be held without exceeding the limits
+func (p *Processor) fits(size int) bool {
+	if p.entriesFull() {
+		return false
+	}
+	return core.Config.ExporterMaxBytes <= 0 || p.heldBytes+size <= core.Config.ExporterMaxBytes
+}
+
+func (p *Processor) entriesFull() bool {
+	return core.Config.ExporterMaxEntries > 0 && len(p.transactions) >= core.Config.ExporterMaxEntries
+}
+
+// takeTransactions returns the held transactions, and releases their space.
+// The mutex must be held by the caller.
+func (p *Processor) takeTransactions() []core.HttpTransaction {
+	transactions := p.transactions
+	p.transactions = nil
+	p.heldBytes = 0
+	p.withoutBodies = 0
+	if p.space != nil {
+		p.space.Broadcast()
+	}
+	return transactions
+}
+
+// dropBodies removes the bodies of the transaction, and returns the size change, which is zero or negative
+func (p *Processor) dropBodies(transaction *core.HttpTransaction) int {
+	before := transactionSize(*transaction)
+	// the original size is kept, so the har body size is not affected
+	transaction.Request.OriginalSize = transaction.Request.BodySize()
+	transaction.Request.Data = ""
+	if transaction.Response != nil {
+		response := *transaction.Response
+		response.OriginalSize = response.BodySize()
+		response.Data = ""
+		transaction.Response = &response
+	}
+	if len(transaction.WebSocketMessages) > 0 {
+		messages := make([]core.HttpWebSocketMessage, len(transaction.WebSocketMessages))
+		for i, message := range transaction.WebSocketMessages {
+			message.Data = ""
+			messages[i] = message
+		}
+		transaction.WebSocketMessages = messages
+	}
+	change := transactionSize(*transaction) - before
+	if change < 0 {
+		transaction.BodiesDropped = true
+		p.drops.DroppedBodies++
+	}
+	return change
+}
+
+// transactionSize estimates the memory used by the transaction data
+func transactionSize(transaction core.HttpTransaction) int {
+	request := transaction.Request
+	size := len(request.Path) + len(request.Query) + entrySize(request.HttpEntry)
+	if transaction.Response != nil {
+		size += entrySize(transaction.Response.HttpEntry)
+	}
+	for _, message := range transaction.WebSocketMessages {
+		size += len(message.Data)
+	}
+	return size
+}
+
+func entrySize(entry core.HttpEntry) int {
+	size := len(entry.Data)
+	for _, header := range entry.Headers {
+		size += len(header)
+	}
+	return size
+}
@@ -0,0 +1,116 @@
+package exporters
+
+import (
+	"github.com/alonana/httshark/core"
+	"sync"
+	"testing"
+	"time"
+)
+
+func limitedProcessor(policy string, maxEntries int, maxBytes int) *Processor {
+	core.Config.ExporterOverflowPolicy = policy
+	core.Config.ExporterMaxEntries = maxEntries
+	core.Config.ExporterMaxBytes = maxBytes
+	p := &Processor{}
+	p.space = sync.NewCond(&p.mutex)
+	return p
+}
+
+func resetLimits() {
+	core.Config.ExporterOverflowPolicy = ""
+	core.Config.ExporterMaxEntries = 0
+	core.Config.ExporterMaxBytes = 0
+}
+
+func sizedTransaction(path string, body string) core.HttpTransaction {
+	return core.HttpTransaction{
+		Request:  core.HttpRequest{Path: path},
+		Response: &core.HttpResponse{HttpEntry: core.HttpEntry{Data: body}},
+	}
+}
+
+func heldPaths(p *Processor) string {
+	var paths string
+	for _, transaction := range p.transactions {
+		paths += transaction.Request.Path
+	}
+	return paths
+}
+
+func TestDropNewest(t *testing.T) {
+	defer resetLimits()
+	p := limitedProcessor(overflowDropNewest, 2, 0)
+	p.add(sizedTransaction("a", ""))
+	p.add(sizedTransaction("b", ""))
+	p.add(sizedTransaction("c", ""))
+	if heldPaths(p) != "ab" || p.drops != (DropCounters{DroppedNewest: 1}) {
+		t.Fatalf("wrong held transactions %v %+v", heldPaths(p), p.drops)
+	}
+}
+
+func TestDropOldest(t *testing.T) {
+	defer resetLimits()
+	p := limitedProcessor(overflowDropOldest, 0, 10)
+	p.add(sizedTransaction("a", "1234"))
+	p.add(sizedTransaction("b", "1234"))
+	p.add(sizedTransaction("c", "1234"))
+	if heldPaths(p) != "bc" || p.heldBytes != 10 || p.drops != (DropCounters{DroppedOldest: 1}) {
+		t.Fatalf("wrong held transactions %v %+v", heldPaths(p), p.drops)
+	}
+}
+
+func TestDropBodies(t *testing.T) {
+	defer resetLimits()
+	p := limitedProcessor(overflowDropBodies, 3, 10)
+	p.add(sizedTransaction("a", "1234"))
+	p.add(sizedTransaction("b", "1234"))
+	// the oldest body is dropped
+	p.add(sizedTransaction("c", "12"))
+	if heldPaths(p) != "abc" || p.heldBytes != 9 || p.drops != (DropCounters{DroppedBodies: 1}) {
+		t.Fatalf("wrong held transactions %v %+v", heldPaths(p), p.drops)
+	}
+	if !p.transactions[0].BodiesDropped || p.transactions[0].Response.Data != "" || p.transactions[1].Response.Data != "1234" {
+		t.Fatalf("wrong dropped bodies %+v", p.transactions)
+	}
+	// the entries limit cannot be solved by dropping bodies
+	p.add(sizedTransaction("d", ""))
+	if heldPaths(p) != "abc" || p.drops.DroppedNewest != 1 {
+		t.Fatalf("wrong held transactions %v %+v", heldPaths(p), p.drops)
+	}
+
+	p.takeTransactions()
+	p.add(sizedTransaction("e", "12345678901234"))
+	if heldPaths(p) != "e" || p.transactions[0].Response.Data != "" || p.drops.DroppedBodies != 2 {
+		t.Fatalf("wrong held transactions %v %+v", heldPaths(p), p.drops)
+	}
+}
+
+func TestBlock(t *testing.T) {
+	defer resetLimits()
+	p := limitedProcessor(overflowBlock, 1, 0)
+	p.mutex.Lock()
+	p.add(sizedTransaction("a", ""))
+	p.mutex.Unlock()
+
+	added := make(chan bool)
+	go func() {
+		p.mutex.Lock()
+		p.add(sizedTransaction("b", ""))
+		p.mutex.Unlock()
+		added <- true
+	}()
+
+	select {
+	case <-added:
+		t.Fatalf("transaction added above the limit")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	p.mutex.Lock()
+	exported := p.takeTransactions()
+	p.mutex.Unlock()
+	<-added
+	if len(exported) != 1 || heldPaths(p) != "b" || p.drops != (DropCounters{Blocked: 1}) {
+		t.Fatalf("wrong held transactions %v %+v", heldPaths(p), p.drops)
+	}
+}
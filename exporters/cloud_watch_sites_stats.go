@@ -27,17 +27,29 @@ func (p *PeriodicSiteStats) init() {
 		for {
 			select {
 			case <-tick.C:
-				    fmt.Printf("cloud_watch_sites_stats. Number of HTTP exchange: %d, size of HTTP exchange: %d\n", p.totalTransactions,p.totalSize)
-					core.CloudWatchClient.PutMetric("total_transactions","Count",
-						float64(p.totalTransactions),core.NAMESPACE)
-					core.CloudWatchClient.PutMetric("total_size","Bytes",
-						float64(p.totalSize),core.NAMESPACE)
-					p.reset()
+				p.publish()
 			}
 		}
 	}
 }
 
+// Close publishes the statistics of the transactions exported since the last publish
+func (p *PeriodicSiteStats) Close() error {
+	if core.Config.SendSiteStatsToCloudWatch {
+		p.publish()
+	}
+	return nil
+}
+
+func (p *PeriodicSiteStats) publish() {
+	fmt.Printf("cloud_watch_sites_stats. Number of HTTP exchange: %d, size of HTTP exchange: %d\n", p.totalTransactions, p.totalSize)
+	core.CloudWatchClient.PutMetric("total_transactions", "Count",
+		float64(p.totalTransactions), core.NAMESPACE)
+	core.CloudWatchClient.PutMetric("total_size", "Bytes",
+		float64(p.totalSize), core.NAMESPACE)
+	p.reset()
+}
+
 func (p *PeriodicSiteStats) Process(harData *har.Har) error {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
@@ -0,0 +1,84 @@
+package exporters
+
+import (
+	"encoding/base64"
+	"github.com/alonana/httshark/core"
+	"github.com/alonana/httshark/har"
+	"golang.org/x/text/encoding/htmlindex"
+	"mime"
+	"unicode/utf8"
+)
+
+const base64Encoding = "base64"
+
+// setContentText sets the content text to the decoded body.
+// A text body in a legacy charset is transcoded to UTF-8 by the charset declared in the content type,
+// and a binary body is base64 encoded.
+// A truncated text body might end in the middle of a character, which is removed from the text.
+func setContentText(content *har.Content, body string, contentType string) {
+	text := transcode(body, contentType)
+	if content.Truncated {
+		text = trimPartialRune(text)
+	}
+	if isText(text) {
+		content.Text = text
+		return
+	}
+	content.Text = base64.StdEncoding.EncodeToString([]byte(body))
+	content.Encoding = base64Encoding
+}
+
+// transcode returns the body transcoded from the charset of the content type to UTF-8.
+// The body is returned as is when the charset is missing, unknown, or UTF-8.
+func transcode(body string, contentType string) string {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil || params["charset"] == "" {
+		return body
+	}
+
+	charset := params["charset"]
+	encoding, err := htmlindex.Get(charset)
+	if err != nil {
+		core.V5("unknown charset %v: %v", charset, err)
+		return body
+	}
+	if name, _ := htmlindex.Name(encoding); name == "utf-8" {
+		return body
+	}
+
+	transcoded, err := encoding.NewDecoder().String(body)
+	if err != nil {
+		core.V5("transcode body from charset %v failed: %v", charset, err)
+		return body
+	}
+	return transcoded
+}
+
+// isText returns whether the body is a valid UTF-8 text,
+// without the control bytes that mark a binary data, as used by the http content sniffing
+func isText(body string) bool {
+	if !utf8.ValidString(body) {
+		return false
+	}
+	for i := 0; i < len(body); i++ {
+		b := body[i]
+		if b <= 0x08 || b == 0x0B || (b >= 0x0E && b <= 0x1A) || (b >= 0x1C && b <= 0x1F) {
+			return false
+		}
+	}
+	return true
+}
+
+// trimPartialRune removes the incomplete UTF-8 character at the end of the text, if any
+func trimPartialRune(text string) string {
+	for i := 1; i < utf8.UTFMax && i <= len(text); i++ {
+		start := len(text) - i
+		if utf8.RuneStart(text[start]) {
+			if utf8.FullRuneInString(text[start:]) {
+				return text
+			}
+			return text[:start]
+		}
+	}
+	return text
+}
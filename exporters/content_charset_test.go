@@ -0,0 +1,54 @@
+package exporters
+
+import (
+	"encoding/base64"
+	"github.com/alonana/httshark/har"
+	"testing"
+)
+
+func TestBinaryContent(t *testing.T) {
+	body := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+	content := har.Content{}
+	setContentText(&content, body, "image/png")
+	if content.Encoding != "base64" || content.Text != base64.StdEncoding.EncodeToString([]byte(body)) {
+		t.Fatalf("binary body should be base64 encoded %+v", content)
+	}
+}
+
+func TestTextContent(t *testing.T) {
+	content := har.Content{}
+	setContentText(&content, "héllo\r\n\tworld", "text/plain")
+	if content.Encoding != "" || content.Text != "héllo\r\n\tworld" {
+		t.Fatalf("wrong text content %+v", content)
+	}
+}
+
+func TestTranscodedContent(t *testing.T) {
+	charsets := map[string]string{
+		"text/html; charset=ISO-8859-1":    "caf\xe9",
+		"text/plain; charset=windows-1255": "\xf9\xec\xe5\xed",
+		"text/plain; charset=utf-16le":     "c\x00a\x00f\x00\xe9\x00",
+		"text/plain; charset=unknown":      "café",
+	}
+	expected := map[string]string{
+		"text/html; charset=ISO-8859-1":    "café",
+		"text/plain; charset=windows-1255": "שלום",
+		"text/plain; charset=utf-16le":     "café",
+		"text/plain; charset=unknown":      "café",
+	}
+	for contentType, body := range charsets {
+		content := har.Content{}
+		setContentText(&content, body, contentType)
+		if content.Encoding != "" || content.Text != expected[contentType] {
+			t.Fatalf("wrong %v content %+v", contentType, content)
+		}
+	}
+}
+
+func TestTruncatedTextContent(t *testing.T) {
+	content := har.Content{Truncated: true}
+	setContentText(&content, "caf\xc3", "text/plain")
+	if content.Encoding != "" || content.Text != "caf" {
+		t.Fatalf("wrong truncated content %+v", content)
+	}
+}
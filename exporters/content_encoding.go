@@ -0,0 +1,133 @@
+package exporters
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"github.com/alonana/httshark/core"
+	"github.com/alonana/httshark/core/aggregated"
+	"github.com/alonana/httshark/har"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+)
+
+// getEncodings returns the codings applied to the body, in the order they were applied.
+// The transfer codings are applied after the content codings, and chunked is already removed by the HTTP parser.
+func getEncodings(headers []har.Pair) []string {
+	var contentCodings []string
+	var transferCodings []string
+	for _, header := range headers {
+		name := strings.ToLower(header.Name)
+		if name != "content-encoding" && name != "transfer-encoding" {
+			continue
+		}
+		for _, coding := range strings.Split(header.Value, ",") {
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding == "" || coding == "identity" || coding == "chunked" {
+				continue
+			}
+			if name == "content-encoding" {
+				contentCodings = append(contentCodings, coding)
+			} else {
+				transferCodings = append(transferCodings, coding)
+			}
+		}
+	}
+	return append(contentCodings, transferCodings...)
+}
+
+// decodeBody decodes the body by the encodings, which are removed in the reverse order of their application.
+// In case the decoding fails, the original body is returned.
+func decodeBody(body string, encodings []string) (string, bool) {
+	if len(body) == 0 || len(encodings) == 0 {
+		return body, false
+	}
+
+	decoded := []byte(body)
+	for i := len(encodings) - 1; i >= 0; i-- {
+		var err error
+		decoded, err = decode(decoded, encodings[i])
+		if err != nil {
+			// tshark decodes the body by itself, so it might be already decoded
+			if utf8.ValidString(body) {
+				core.V2("decode %v body failed, keeping the body as is: %v", encodings[i], err)
+			} else {
+				aggregated.Warn("decode %v body failed: %v", encodings[i], core.LimitedError(err))
+			}
+			return body, false
+		}
+	}
+	return string(decoded), true
+}
+
+func decode(data []byte, encoding string) ([]byte, error) {
+	var reader io.Reader
+	switch encoding {
+	case "gzip", "x-gzip":
+		gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		reader = gzipReader
+	case "deflate":
+		// deflate should be zlib wrapped, but some servers send a raw deflate stream
+		zlibReader, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			reader = flate.NewReader(bytes.NewReader(data))
+		} else {
+			reader = zlibReader
+		}
+	case "br":
+		reader = brotli.NewReader(bytes.NewReader(data))
+	case "zstd":
+		zstdReader, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderMaxMemory(uint64(core.Config.DecodedBodyMaxSize)+1))
+		if err != nil {
+			return nil, err
+		}
+		defer zstdReader.Close()
+		reader = zstdReader
+	default:
+		return nil, fmt.Errorf("unsupported encoding")
+	}
+
+	decoded, err := ioutil.ReadAll(io.LimitReader(reader, int64(core.Config.DecodedBodyMaxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) > core.Config.DecodedBodyMaxSize {
+		return nil, fmt.Errorf("decoded body is above %v bytes", core.Config.DecodedBodyMaxSize)
+	}
+	return decoded, nil
+}
+
+// setDecodedContent sets the content text to the decoded body, and returns the decoded body.
+// The content size is the decoded size, and the compression is the bytes saved by the encodings.
+// The truncation of the content should be set before, as it affects the text, see setContentText.
+func setDecodedContent(content *har.Content, body string, headers []har.Pair) string {
+	encodings := getEncodings(headers)
+	decoded, isDecoded := decodeBody(body, encodings)
+	content.Size = len(decoded)
+	setContentText(content, decoded, getHeaderValue(headers, "Content-Type"))
+	if len(encodings) > 0 {
+		content.ContentEncoding = strings.Join(encodings, ", ")
+	}
+	if isDecoded {
+		content.Compression = len(decoded) - len(body)
+	}
+	return decoded
+}
+
+// setTruncatedContent marks the content of a body that was truncated by the max body size
+func setTruncatedContent(content *har.Content, entry core.HttpEntry) {
+	if !entry.Truncated {
+		return
+	}
+	content.Truncated = true
+	content.OriginalSize = entry.OriginalSize
+}
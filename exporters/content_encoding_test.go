@@ -0,0 +1,100 @@
+package exporters
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"github.com/alonana/httshark/core"
+	"github.com/alonana/httshark/core/aggregated"
+	"github.com/alonana/httshark/har"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var aggregatedLogOnce sync.Once
+
+func initDecoding() {
+	aggregatedLogOnce.Do(func() {
+		core.Config.AggregatedLogInterval = time.Hour
+		aggregated.InitLog()
+	})
+	core.Config.DecodedBodyMaxSize = 1024
+}
+
+func encode(t *testing.T, encoding string, body string) string {
+	var buffer bytes.Buffer
+	var writer io.WriteCloser
+	switch encoding {
+	case "gzip":
+		writer = gzip.NewWriter(&buffer)
+	case "deflate":
+		writer = zlib.NewWriter(&buffer)
+	case "br":
+		writer = brotli.NewWriter(&buffer)
+	case "zstd":
+		zstdWriter, err := zstd.NewWriter(&buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer = zstdWriter
+	}
+	_, _ = writer.Write([]byte(body))
+	_ = writer.Close()
+	return buffer.String()
+}
+
+func TestDecodeContent(t *testing.T) {
+	initDecoding()
+	body := strings.Repeat(`{"name":"value"}`, 20)
+	for _, encoding := range []string{"gzip", "deflate", "br", "zstd"} {
+		encoded := encode(t, encoding, body)
+		content := har.Content{}
+		setDecodedContent(&content, encoded, []har.Pair{{Name: "Content-Encoding", Value: encoding}})
+		if content.Text != body || content.Size != len(body) || content.Compression != len(body)-len(encoded) {
+			t.Fatalf("wrong %v content %+v", encoding, content)
+		}
+		if content.ContentEncoding != encoding {
+			t.Fatalf("wrong %v content encoding %v", encoding, content.ContentEncoding)
+		}
+	}
+}
+
+func TestDecodeContentMultipleEncodings(t *testing.T) {
+	initDecoding()
+	body := "multiple encodings"
+	encoded := encode(t, "gzip", encode(t, "br", body))
+	content := har.Content{}
+	setDecodedContent(&content, encoded, []har.Pair{
+		{Name: "Content-Encoding", Value: "br"},
+		{Name: "Transfer-Encoding", Value: "gzip, chunked"},
+	})
+	if content.Text != body || content.ContentEncoding != "br, gzip" {
+		t.Fatalf("wrong content %+v", content)
+	}
+}
+
+func TestDecodeContentKeptEncoded(t *testing.T) {
+	initDecoding()
+
+	// above the decoded size limit
+	encoded := encode(t, "gzip", strings.Repeat("a", 2000))
+	content := har.Content{}
+	setDecodedContent(&content, encoded, []har.Pair{{Name: "Content-Encoding", Value: "gzip"}})
+	if content.Text != base64.StdEncoding.EncodeToString([]byte(encoded)) || content.Encoding != "base64" ||
+		content.Size != len(encoded) || content.Compression != 0 {
+		t.Fatalf("body above the limit should be kept encoded %+v", content)
+	}
+
+	// already decoded by tshark
+	content = har.Content{}
+	setDecodedContent(&content, "plain", []har.Pair{{Name: "Content-Encoding", Value: "gzip"}})
+	if content.Text != "plain" || content.ContentEncoding != "gzip" {
+		t.Fatalf("decoded body should be kept %+v", content)
+	}
+}
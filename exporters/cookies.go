@@ -0,0 +1,122 @@
+package exporters
+
+import (
+	"github.com/alonana/httshark/har"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const cookieTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// the expires formats used by the servers, in addition to the HTTP date formats
+var cookieExpiresFormats = []string{
+	"Mon, 02-Jan-2006 15:04:05 MST",
+	"Mon, 02-Jan-06 15:04:05 MST",
+}
+
+// getRequestCookies returns the cookies of the Cookie headers
+func getRequestCookies(headers []har.Pair) []har.Cookie {
+	cookies := make([]har.Cookie, 0)
+	for _, header := range headers {
+		if !strings.EqualFold(header.Name, "Cookie") {
+			continue
+		}
+		for _, part := range strings.Split(header.Value, ";") {
+			name, value := splitCookiePair(part)
+			if name == "" {
+				continue
+			}
+			cookies = append(cookies, har.Cookie{Name: name, Value: value})
+		}
+	}
+	return cookies
+}
+
+// getResponseCookies returns the cookies of the Set-Cookie headers, with their attributes.
+// The Max-Age attribute is relative to the response time, and takes precedence over the Expires attribute.
+func getResponseCookies(headers []har.Pair, responseTime time.Time) []har.Cookie {
+	cookies := make([]har.Cookie, 0)
+	for _, header := range headers {
+		if !strings.EqualFold(header.Name, "Set-Cookie") {
+			continue
+		}
+		parts := strings.Split(header.Value, ";")
+		name, value := splitCookiePair(parts[0])
+		if name == "" {
+			continue
+		}
+
+		cookie := har.Cookie{Name: name, Value: value}
+		maxAge := false
+		for _, attribute := range parts[1:] {
+			attributeName, attributeValue := splitCookiePair(attribute)
+			switch strings.ToLower(attributeName) {
+			case "path":
+				cookie.Path = attributeValue
+			case "domain":
+				cookie.Domain = attributeValue
+			case "expires":
+				if !maxAge {
+					cookie.Expires = getCookieExpires(attributeValue)
+				}
+			case "max-age":
+				seconds, err := strconv.Atoi(attributeValue)
+				if err != nil {
+					continue
+				}
+				maxAge = true
+				// a zero or negative max age expires the cookie immediately
+				expires := time.Unix(0, 0)
+				if seconds > 0 {
+					expires = responseTime.Add(time.Duration(seconds) * time.Second)
+				}
+				cookie.Expires = expires.UTC().Format(cookieTimeFormat)
+			case "httponly":
+				cookie.HttpOnly = true
+			case "secure":
+				cookie.Secure = true
+			case "samesite":
+				cookie.SameSite = getSameSite(attributeValue)
+			}
+		}
+		cookies = append(cookies, cookie)
+	}
+	return cookies
+}
+
+// splitCookiePair splits a name=value pair, where the value might be missing
+func splitCookiePair(pair string) (string, string) {
+	pair = strings.TrimSpace(pair)
+	position := strings.Index(pair, "=")
+	if position == -1 {
+		return pair, ""
+	}
+	return strings.TrimSpace(pair[:position]), strings.TrimSpace(pair[position+1:])
+}
+
+// getCookieExpires returns the expires attribute in ISO 8601 format, or as is if it cannot be parsed
+func getCookieExpires(value string) string {
+	expires, err := http.ParseTime(value)
+	for i := 0; err != nil && i < len(cookieExpiresFormats); i++ {
+		expires, err = time.Parse(cookieExpiresFormats[i], value)
+	}
+	if err != nil {
+		return value
+	}
+	return expires.UTC().Format(cookieTimeFormat)
+}
+
+// getSameSite returns the SameSite attribute using the browsers casing, or as is if it is unknown
+func getSameSite(value string) string {
+	switch strings.ToLower(value) {
+	case "strict":
+		return "Strict"
+	case "lax":
+		return "Lax"
+	case "none":
+		return "None"
+	}
+	return value
+}
@@ -0,0 +1,59 @@
+package exporters
+
+import (
+	"github.com/alonana/httshark/har"
+	"testing"
+	"time"
+)
+
+func TestRequestCookies(t *testing.T) {
+	cookies := getRequestCookies([]har.Pair{
+		{Name: "cookie", Value: "session=abc; theme=dark"},
+		{Name: "Accept", Value: "*/*"},
+		{Name: "Cookie", Value: "flag; empty="},
+	})
+
+	expected := []har.Cookie{
+		{Name: "session", Value: "abc"},
+		{Name: "theme", Value: "dark"},
+		{Name: "flag"},
+		{Name: "empty"},
+	}
+	if len(cookies) != len(expected) {
+		t.Fatalf("expected %v cookies, but got %+v", len(expected), cookies)
+	}
+	for i, cookie := range cookies {
+		if cookie != expected[i] {
+			t.Fatalf("expected cookie %+v, but got %+v", expected[i], cookie)
+		}
+	}
+}
+
+func TestResponseCookies(t *testing.T) {
+	responseTime := time.Date(2020, 4, 6, 10, 0, 0, 0, time.UTC)
+	cookies := getResponseCookies([]har.Pair{
+		{Name: "Set-Cookie", Value: "session=abc; Path=/; Domain=example.com; Secure; HttpOnly; SameSite=lax"},
+		{Name: "set-cookie", Value: "theme=dark; Expires=Wed, 21 Oct 2020 07:28:00 GMT"},
+		{Name: "Set-Cookie", Value: "legacy=1; expires=Wed, 21-Oct-2020 07:28:00 GMT"},
+		{Name: "Set-Cookie", Value: "short=1; Max-Age=60; Expires=Wed, 21 Oct 2020 07:28:00 GMT"},
+		{Name: "Set-Cookie", Value: "gone=; Max-Age=0"},
+		{Name: "Set-Cookie", Value: "odd=1; Expires=someday; SameSite=Custom"},
+	}, responseTime)
+
+	expected := []har.Cookie{
+		{Name: "session", Value: "abc", Path: "/", Domain: "example.com", Secure: true, HttpOnly: true, SameSite: "Lax"},
+		{Name: "theme", Value: "dark", Expires: "2020-10-21T07:28:00.000Z"},
+		{Name: "legacy", Value: "1", Expires: "2020-10-21T07:28:00.000Z"},
+		{Name: "short", Value: "1", Expires: "2020-04-06T10:01:00.000Z"},
+		{Name: "gone", Expires: "1970-01-01T00:00:00.000Z"},
+		{Name: "odd", Value: "1", Expires: "someday", SameSite: "Custom"},
+	}
+	if len(cookies) != len(expected) {
+		t.Fatalf("expected %v cookies, but got %+v", len(expected), cookies)
+	}
+	for i, cookie := range cookies {
+		if cookie != expected[i] {
+			t.Fatalf("expected cookie %+v, but got %+v", expected[i], cookie)
+		}
+	}
+}
@@ -16,7 +16,7 @@ func HarToFile(harData *har.Har) error {
 	}
 	appIdPrefix := ""
 	if core.Config.SplitByAppId {
-		appIdPrefix = harData.Log.Entries[0].GetAppId() + "_"
+		appIdPrefix = harData.Log.Entries[0].GetAppIdFileName() + "_"
 	}
 
 	formattedTime := time.Now().Format("2006-01-02T15:04:05")
@@ -0,0 +1,81 @@
+package exporters
+
+import (
+	"github.com/alonana/httshark/core"
+	"github.com/alonana/httshark/har"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"strings"
+)
+
+const mimeTypeForm = "application/x-www-form-urlencoded"
+const mimeTypeMultipart = "multipart/form-data"
+
+// getPostData returns the request content as the post data of the request.
+// The params are parsed from the decoded body of URL encoded and multipart requests,
+// other bodies, e.g. JSON, have only the text.
+func (p *Processor) getPostData(content har.Content, body string, headers []har.Pair) *har.PostData {
+	postData := &har.PostData{
+		MimeType:        getHeaderValue(headers, "Content-Type"),
+		Params:          make([]har.Param, 0),
+		Text:            content.Text,
+		Encoding:        content.Encoding,
+		ContentEncoding: content.ContentEncoding,
+		Truncated:       content.Truncated,
+		OriginalSize:    content.OriginalSize,
+	}
+
+	mediaType, mediaParams, err := mime.ParseMediaType(postData.MimeType)
+	if err != nil {
+		return postData
+	}
+	switch mediaType {
+	case mimeTypeForm:
+		for _, pair := range p.getQueryString(body) {
+			postData.Params = append(postData.Params, har.Param{Name: pair.Name, Value: pair.Value})
+		}
+	case mimeTypeMultipart:
+		postData.Params = getMultipartParams(body, mediaParams["boundary"])
+	}
+	return postData
+}
+
+// getMultipartParams returns a param for each part of a multipart body.
+// The parts of a truncated body are returned up to the truncated part, which is returned with its partial value.
+// The value of an uploaded file is omitted when the elide-uploaded-files flag is set,
+// and a binary value is omitted as the params have no encoding, while the post data text keeps it base64 encoded.
+func getMultipartParams(body string, boundary string) []har.Param {
+	params := make([]har.Param, 0)
+	if boundary == "" {
+		return params
+	}
+
+	reader := multipart.NewReader(strings.NewReader(body), boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return params
+		}
+		if err != nil {
+			core.V5("read multipart part failed: %v", err)
+			return params
+		}
+
+		data, err := ioutil.ReadAll(part)
+		param := har.Param{
+			Name:        part.FormName(),
+			FileName:    part.FileName(),
+			ContentType: part.Header.Get("Content-Type"),
+		}
+		if (param.FileName == "" || !core.Config.ElideUploadedFiles) && isText(string(data)) {
+			param.Value = string(data)
+		}
+		params = append(params, param)
+		if err != nil {
+			core.V5("read multipart part %v failed: %v", param.Name, err)
+			return params
+		}
+	}
+}
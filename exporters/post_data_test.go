@@ -0,0 +1,78 @@
+package exporters
+
+import (
+	"github.com/alonana/httshark/core"
+	"github.com/alonana/httshark/har"
+	"strings"
+	"testing"
+)
+
+const multipartBody = "--XyZ\r\n" +
+	"Content-Disposition: form-data; name=\"title\"\r\n\r\n" +
+	"my photo\r\n" +
+	"--XyZ\r\n" +
+	"Content-Disposition: form-data; name=\"photo\"; filename=\"cat.png\"\r\n" +
+	"Content-Type: image/png\r\n\r\n" +
+	"PNG-DATA\r\n" +
+	"--XyZ--\r\n"
+
+func postData(t *testing.T, contentType string, body string) *har.PostData {
+	p, _ := createMemoryProcessor()
+	headers := []har.Pair{{Name: "Content-Type", Value: contentType}}
+	postData := p.getPostData(har.Content{Text: body}, body, headers)
+	if postData.MimeType != contentType || postData.Text != body {
+		t.Fatalf("wrong post data %+v", postData)
+	}
+	return postData
+}
+
+func paramsString(params []har.Param) string {
+	var parts []string
+	for _, param := range params {
+		parts = append(parts, param.Name+"|"+param.Value+"|"+param.FileName+"|"+param.ContentType)
+	}
+	return strings.Join(parts, ",")
+}
+
+func TestFormPostData(t *testing.T) {
+	data := postData(t, "application/x-www-form-urlencoded; charset=UTF-8", "name=a+b&id=1&id=2")
+	if paramsString(data.Params) != "name|a b||,id|1||,id|2||" {
+		t.Fatalf("wrong params %+v", data.Params)
+	}
+}
+
+func TestMultipartPostData(t *testing.T) {
+	data := postData(t, "multipart/form-data; boundary=XyZ", multipartBody)
+	if paramsString(data.Params) != "title|my photo||,photo|PNG-DATA|cat.png|image/png" {
+		t.Fatalf("wrong params %+v", data.Params)
+	}
+
+	core.Config.ElideUploadedFiles = true
+	defer func() { core.Config.ElideUploadedFiles = false }()
+	data = postData(t, "multipart/form-data; boundary=XyZ", multipartBody)
+	if paramsString(data.Params) != "title|my photo||,photo||cat.png|image/png" {
+		t.Fatalf("wrong elided params %+v", data.Params)
+	}
+}
+
+func TestBinaryMultipartPostData(t *testing.T) {
+	body := strings.Replace(multipartBody, "PNG-DATA", "\x89PNG\x00", 1)
+	data := postData(t, "multipart/form-data; boundary=XyZ", body)
+	if paramsString(data.Params) != "title|my photo||,photo||cat.png|image/png" {
+		t.Fatalf("wrong params %+v", data.Params)
+	}
+}
+
+func TestTruncatedMultipartPostData(t *testing.T) {
+	data := postData(t, "multipart/form-data; boundary=XyZ", multipartBody[:strings.Index(multipartBody, "PNG-")+3])
+	if paramsString(data.Params) != "title|my photo||,photo|PNG|cat.png|image/png" {
+		t.Fatalf("wrong params %+v", data.Params)
+	}
+}
+
+func TestJsonPostData(t *testing.T) {
+	data := postData(t, "application/json", `{"a":1}`)
+	if len(data.Params) != 0 {
+		t.Fatalf("expected no params, but got %+v", data.Params)
+	}
+}
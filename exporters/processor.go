@@ -3,10 +3,12 @@ package exporters
 import (
 	"fmt"
 	"github.com/alonana/httshark/core"
-	"github.com/alonana/httshark/core/aggregated"
 	"github.com/alonana/httshark/har"
 	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -14,12 +16,28 @@ import (
 
 type HarProcessor func(*har.Har) error
 
+// HarCloser flushes the data that a har processor holds, once the processor stops
+type HarCloser func() error
+
+type namedCloser struct {
+	name  string
+	close HarCloser
+}
+
+// StopSummary describes what the processor exported and lost when it stopped
+type StopSummary struct {
+	Flushed       int          // held and queued transactions exported on stop
+	Drops         DropCounters // the overflow policy decisions while stopping
+	FailedClosers []string     // har processors that failed to flush their data
+}
+
 func CreateProcessor(logger *logrus.Logger ) *Processor {
 	processor := Processor{Logger: logger}
 	processors := strings.Split(core.Config.HarProcessors, ",")
 	for i := 0; i < len(processors); i++ {
 		name := processors[i]
 		var harProcessor HarProcessor
+		var closer HarCloser
 		if name == "sampled-transactions" {
 			s := SampleTransactions{}
 			go s.init()
@@ -28,22 +46,29 @@ func CreateProcessor(logger *logrus.Logger ) *Processor {
 			s := SitesStats{Logger: logger}
 			go s.init()
 			harProcessor = s.Process
+			closer = s.Close
 		} else if name == "cw-sites-stats" {
 			s := PeriodicSiteStats{}
 			go s.init()
 			harProcessor = s.Process
+			closer = s.Close
 		} else if name == "file" {
 			harProcessor = HarToFile
 		} else if name == "s3" {
 			s := S3Client{Logger: logger}
 			go s.init()
 			harProcessor = s.Process
+			closer = s.Close
 		} else {
 			s := TransactionsSizes{}
 			go s.init()
 			harProcessor = s.Process
+			closer = s.Close
 		}
 		processor.processors = append(processor.processors, harProcessor)
+		if closer != nil {
+			processor.closers = append(processor.closers, namedCloser{name: name, close: closer})
+		}
 	}
 	return &processor
 }
@@ -57,9 +82,17 @@ type Processor struct {
 	stopChannel         chan bool
 	stopped             bool
 	processors          []HarProcessor
+	closers             []namedCloser
 	count               uint64
 	lastTransactionTime time.Time
 	contentTypesToKeep  []string
+	hosts               *core.Hosts
+	heldBytes           int        // the estimated size of the held transactions
+	withoutBodies       int        // the held transactions, oldest first, whose bodies were dropped
+	space               *sync.Cond // signaled when the held transactions are exported
+	closing             bool
+	drops               DropCounters
+	reportedDrops       DropCounters
 }
 
 func (p *Processor) process(harFile *har.Har) error {
@@ -79,14 +112,43 @@ func (p *Processor) Start() {
 	p.input = make(chan core.HttpTransaction, core.Config.ChannelBuffer)
 	p.waitGroup.Add(2)
 	p.contentTypesToKeep = strings.Split(core.Config.KeepContentTypes, ",")
+	p.hosts = core.CapturedHosts()
+	p.space = sync.NewCond(&p.mutex)
 	go p.aggregate()
 	go p.export()
 }
 
-func (p *Processor) Stop() {
+// Stop the processor, export the held and the queued transactions, and close the har processors
+func (p *Processor) Stop() StopSummary {
+	// release the aggregation if it waits for space
+	p.mutex.Lock()
+	p.closing = true
+	p.space.Broadcast()
+	drops := p.drops
+	p.mutex.Unlock()
+
 	p.stopChannel <- true
 	p.stopChannel <- true
 	p.waitGroup.Wait()
+
+	// export whatever is left
+	p.mutex.Lock()
+	for len(p.input) > 0 {
+		p.add(<-p.input)
+	}
+	toExport := p.takeTransactions()
+	summary := StopSummary{Flushed: len(toExport), Drops: p.drops.sub(drops)}
+	p.mutex.Unlock()
+	p.dumpTransactions(toExport)
+
+	for _, closer := range p.closers {
+		err := closer.close()
+		if err != nil {
+			p.Logger.Warn(fmt.Sprintf("close %v har processor failed: %v", closer.name, err))
+			summary.FailedClosers = append(summary.FailedClosers, closer.name)
+		}
+	}
+	return summary
 }
 
 func (p *Processor) Queue(transaction core.HttpTransaction) {
@@ -109,8 +171,7 @@ func (p *Processor) export() {
 		case <-tick.C:
 
 			p.mutex.Lock()
-			toExport := p.transactions
-			p.transactions = nil
+			toExport := p.takeTransactions()
 			p.mutex.Unlock()
 
 			p.dumpTransactions(toExport)
@@ -131,7 +192,7 @@ func (p *Processor) aggregate() {
 		case transaction := <-p.input:
 			core.V5("got transaction %+v", transaction)
 			p.mutex.Lock()
-			p.transactions = append(p.transactions, transaction)
+			p.add(transaction)
 			p.mutex.Unlock()
 
 		case <-p.stopChannel:
@@ -148,8 +209,8 @@ func shouldDumpEntry(entry har.Entry) bool {
 	if core.Config.IgnoreHealthCheck {
 		for i := 0; i < len(entry.Request.Headers); i++ {
 			pair := entry.Request.Headers[i]
-			if (pair.Name == "Host" && pair.Value == "HOST_FOR_HC") ||
-			   (pair.Name == "X-RDWR-HC" && pair.Value == "health check") {
+			if (strings.EqualFold(pair.Name, "Host") && pair.Value == "HOST_FOR_HC") ||
+			   (strings.EqualFold(pair.Name, "X-RDWR-HC") && pair.Value == "health check") {
 				  return false
 			}
 		}
@@ -157,7 +218,17 @@ func shouldDumpEntry(entry har.Entry) bool {
 	return true
 }
 
+// the capture filter might capture other hosts, for example the reverse direction of a strict filter
+func (p *Processor) shouldDumpTransaction(transaction core.HttpTransaction) bool {
+	destination := transaction.Request.HttpIpAndPort
+	if destination.DstIP == "" {
+		return true
+	}
+	return p.hosts.Match(destination.DstIP, destination.DstPort)
+}
+
 func (p *Processor) dumpTransactions(transactions []core.HttpTransaction) {
+	p.logDrops()
 	if len(transactions) == 0 {
 		p.Logger.Info(fmt.Sprintf("no transactions dumped"))
 		return
@@ -166,6 +237,11 @@ func (p *Processor) dumpTransactions(transactions []core.HttpTransaction) {
 	idx := 0
 	numOfIgnoredEntries := 0
 	for idx < len(transactions) {
+		if !p.shouldDumpTransaction(transactions[idx]) {
+			numOfIgnoredEntries++
+			idx++
+			continue
+		}
 		entry := p.convert(transactions[idx])
 		if shouldDumpEntry(entry) {
 			entries = append(entries,entry)
@@ -230,10 +306,10 @@ func (p *Processor) convert(transaction core.HttpTransaction) har.Entry {
 	request := transaction.Request
 	response := transaction.Response
 
-	duration := 0
 	harResponse := har.Response{
 		Exists:      false,
 		Cookies:     make([]har.Cookie, 0),
+		Headers:     make([]har.Pair, 0),
 		HeadersSize: -1,
 		Content: har.Content{
 			Size:     0,
@@ -243,47 +319,70 @@ func (p *Processor) convert(transaction core.HttpTransaction) har.Entry {
 	}
 	if response != nil {
 		harResponse.Exists = true
-		duration = int(response.Time.Sub(*request.Time).Milliseconds())
 		harResponse.Status = response.Code
+		harResponse.StatusText = getStatusText(*response)
 		harResponse.Headers = p.getHeaders(response.Headers)
+		harResponse.Cookies = getResponseCookies(harResponse.Headers, *response.Time)
 		harResponse.HeadersSize = p.getHeadersSize(response.Headers)
 		harResponse.HttpVersion = response.Version
-		harResponse.BodySize = len(response.Data)
-		harResponse.Content.Size = len(response.Data)
-		harResponse.Content.Text = response.Data
-
-		if !p.shouldKeep(harResponse.Headers) {
-			harResponse.Content.Text = ""
-		}
+		harResponse.RedirectUrl = getHeaderValue(harResponse.Headers, "Location")
+		harResponse.BodySize = response.BodySize()
+		harResponse.Content.MimeType = getHeaderValue(harResponse.Headers, "Content-Type")
+		p.setResponseContent(&harResponse.Content, response.HttpEntry, harResponse.Headers)
 	}
 
 	harRequest := har.Request{
 		AppId:       &har.AppIdentifier{DstIP: request.HttpIpAndPort.DstIP, DstPort: request.HttpIpAndPort.DstPort},
 		Method:      request.Method,
-		Url:         request.Path,
 		HttpVersion: request.Version,
 		Headers:     p.getHeaders(request.Headers),
 		QueryString: p.getQueryString(request.Query),
-		Cookies:     make([]har.Cookie, 0),
 		HeadersSize: p.getHeadersSize(request.Headers),
-		BodySize:    len(request.Data),
-		Content: har.Content{
-			Size:     len(request.Data),
-			MimeType: "",
-			Text:     request.Data,
-		},
+		BodySize:    request.BodySize(),
 	}
-	if !p.shouldKeep(harRequest.Headers) {
-		harResponse.Content.Text = ""
+	harRequest.Url = getUrl(request, harRequest.Headers)
+	harRequest.Cookies = getRequestCookies(harRequest.Headers)
+	if harRequest.BodySize > 0 {
+		var content har.Content
+		setTruncatedContent(&content, request.HttpEntry)
+		body := setDecodedContent(&content, request.Data, harRequest.Headers)
+		harRequest.PostData = p.getPostData(content, body, harRequest.Headers)
 	}
 
-
-	return har.Entry{
-		Started:  request.Time.Format("2006-01-02T15:04:05.000Z"),
-		Time:     duration,
+	timings := getTimings(request, response)
+	entry := har.Entry{
+		Started:  request.Time.UTC().Format("2006-01-02T15:04:05.000Z"),
+		Time:     totalTime(timings),
 		Request:  harRequest,
 		Response: harResponse,
+		Timings:  timings,
+
+		ServerIPAddress: request.HttpIpAndPort.DstIP,
+		Connection:      request.HttpIpAndPort.ConnectionID,
+		ClientIPAddress: request.HttpIpAndPort.SrcIP,
+	}
+	if transaction.Tunnel != nil {
+		entry.Tunnel = &har.Tunnel{
+			Encapsulation: transaction.Tunnel.Encapsulation,
+			VlanID:        transaction.Tunnel.VlanID,
+			VNI:           transaction.Tunnel.VNI,
+			GreKey:        transaction.Tunnel.GreKey,
+			ErspanSession: transaction.Tunnel.ErspanSession,
+		}
+	}
+	entry.BodiesDropped = transaction.BodiesDropped
+	if transaction.TcpMetrics != nil {
+		entry.TCP = getTCPMetrics(transaction.TcpMetrics)
 	}
+	for _, message := range transaction.WebSocketMessages {
+		entry.WebSocketMessages = append(entry.WebSocketMessages, har.WebSocketMessage{
+			Type:   message.Type,
+			Time:   float64(message.Time.UnixNano()) / float64(time.Second),
+			Opcode: message.Opcode,
+			Data:   message.Data,
+		})
+	}
+	return entry
 }
 
 func (p *Processor) getHeaders(headers []string) []har.Pair {
@@ -320,26 +419,91 @@ func (p *Processor) getHeader(header string) har.Pair {
 	return halHeader
 }
 
-func (p *Processor) getQueryString(query string) []har.Pair {
-	queryString := make([]har.Pair, 0)
-	values, err := url.ParseQuery(query)
+// getUrl returns the absolute request URL, including the query string.
+// A request path without a host, e.g. from tshark or an HTTP/1.0 request, is completed
+// by the Host header, or by the destination of the request.
+func getUrl(request core.HttpRequest, headers []har.Pair) string {
+	requestUrl, err := url.Parse(request.Path)
 	if err != nil {
-		core.V5("parse query string %s failed: %v", query, err)
-		aggregated.Warn("parse query string failed: %v", core.LimitedError(err))
-		return queryString
+		requestUrl = &url.URL{Path: request.Path}
+	}
+	if requestUrl.Scheme == "" {
+		requestUrl.Scheme = "http"
+	}
+	if requestUrl.Host == "" {
+		requestUrl.Host = getHeaderValue(headers, "Host")
 	}
+	if requestUrl.Host == "" && request.HttpIpAndPort.DstIP != "" {
+		requestUrl.Host = net.JoinHostPort(request.HttpIpAndPort.DstIP, strconv.Itoa(request.HttpIpAndPort.DstPort))
+	}
+	if requestUrl.Path == "" {
+		requestUrl.Path = "/"
+	}
+	requestUrl.RawQuery = request.Query
+	return requestUrl.String()
+}
 
-	for k, v := range values {
-		pair := har.Pair{
-			Name:  k,
-			Value: v[0],
+// getStatusText returns the captured reason phrase, or the standard one when it was not captured
+func getStatusText(response core.HttpResponse) string {
+	if response.StatusText != "" {
+		return response.StatusText
+	}
+	return http.StatusText(response.Code)
+}
+
+// getHeaderValue returns the value of the first header with the name, or an empty string if it is missing
+func getHeaderValue(headers []har.Pair, name string) string {
+	for _, header := range headers {
+		if strings.EqualFold(header.Name, name) {
+			return header.Value
 		}
-		queryString = append(queryString, pair)
 	}
+	return ""
+}
 
+// getQueryString returns the query parameters in their order, including the repeated parameters.
+// A parameter that cannot be unescaped is kept raw.
+func (p *Processor) getQueryString(query string) []har.Pair {
+	queryString := make([]har.Pair, 0)
+	for _, parameter := range strings.Split(query, "&") {
+		if parameter == "" {
+			continue
+		}
+		name := parameter
+		value := ""
+		position := strings.Index(parameter, "=")
+		if position != -1 {
+			name = parameter[:position]
+			value = parameter[position+1:]
+		}
+		queryString = append(queryString, har.Pair{
+			Name:  unescapeQuery(name),
+			Value: unescapeQuery(value),
+		})
+	}
 	return queryString
 }
 
+func unescapeQuery(raw string) string {
+	unescaped, err := url.QueryUnescape(raw)
+	if err != nil {
+		core.V5("unescape query %s failed: %v", raw, err)
+		return raw
+	}
+	return unescaped
+}
+
+
+// setResponseContent sets the content of the response body.
+// A body whose content type should not be kept is not decoded, its text is empty, and its size is the captured size.
+func (p *Processor) setResponseContent(content *har.Content, entry core.HttpEntry, headers []har.Pair) {
+	setTruncatedContent(content, entry)
+	if !p.shouldKeep(headers) {
+		content.Size = len(entry.Data)
+		return
+	}
+	setDecodedContent(content, entry.Data, headers)
+}
 
 func (p *Processor) shouldKeep(headers []har.Pair) bool {
 	for i := 0; i < len(headers); i++ {
@@ -1,16 +1,48 @@
 package exporters
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/alonana/httshark/core"
+	"github.com/alonana/httshark/har"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
+// memoryHars collects the hars exported by the processor
+type memoryHars struct {
+	mutex sync.Mutex
+	hars  []*har.Har
+}
+
+func (m *memoryHars) process(harFile *har.Har) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.hars = append(m.hars, harFile)
+	return nil
+}
+
+func (m *memoryHars) get() []*har.Har {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.hars
+}
+
+func createMemoryProcessor() (*Processor, *memoryHars) {
+	core.Config.HarProcessors = "file"
+	memory := &memoryHars{}
+	p := CreateProcessor(logrus.New())
+	p.processors = []HarProcessor{memory.process}
+	return p, memory
+}
+
 func TestEmpty(t *testing.T) {
 	core.Config.Verbose = 5
 	core.Config.ExportInterval = time.Millisecond
-	p := CreateProcessor()
+	p, _ := createMemoryProcessor()
 	p.Start()
 	p.Stop()
 }
@@ -18,8 +50,8 @@ func TestEmpty(t *testing.T) {
 func TestTransactions(t *testing.T) {
 	core.Config.Verbose = 5
 	core.Config.ExportInterval = time.Millisecond
-	core.Config.DropContentTypes = "image,audio,video"
-	p := CreateProcessor()
+	core.Config.KeepContentTypes = "json,xml,x-application-form"
+	p, memory := createMemoryProcessor()
 	p.Start()
 
 	now := time.Now()
@@ -51,15 +83,16 @@ func TestTransactions(t *testing.T) {
 
 	time.Sleep(20 * time.Millisecond)
 
-	if len(MemoryHars) != 1 {
-		t.Fatalf("expected one item, but got %v", len(MemoryHars))
+	hars := memory.get()
+	if len(hars) != 1 {
+		t.Fatalf("expected one item, but got %v", len(hars))
 	}
 
-	harData := MemoryHars[0]
+	harData := hars[0]
 	fmt.Printf("%+v\n", harData)
 
 	entry := harData.Log.Entries[0]
-	if entry.Request.Content.Text == "" {
+	if entry.Request.PostData == nil || entry.Request.PostData.Text == "" {
 		t.Fatalf("request content should not had been dropped")
 	}
 	if entry.Response.Content.Text != "" {
@@ -68,3 +101,181 @@ func TestTransactions(t *testing.T) {
 
 	p.Stop()
 }
+
+func TestStopFlushes(t *testing.T) {
+	core.Config.ExportInterval = time.Hour
+	p, memory := createMemoryProcessor()
+	var closedAfterExport bool
+	p.closers = []namedCloser{
+		{name: "memory", close: func() error {
+			closedAfterExport = len(memory.get()) == 1
+			return nil
+		}},
+		{name: "broken", close: func() error {
+			return fmt.Errorf("broken")
+		}},
+	}
+	p.Start()
+
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		p.Queue(core.HttpTransaction{
+			Request: core.HttpRequest{
+				HttpEntry: core.HttpEntry{Time: &now},
+				Method:    "GET",
+				Path:      fmt.Sprintf("/%v", i),
+			},
+		})
+	}
+	summary := p.Stop()
+
+	if summary.Flushed != 2 {
+		t.Fatalf("expected 2 flushed transactions, but got %v", summary.Flushed)
+	}
+	if !closedAfterExport {
+		t.Fatalf("har processors should be closed after the export")
+	}
+	if len(summary.FailedClosers) != 1 || summary.FailedClosers[0] != "broken" {
+		t.Fatalf("wrong failed closers %v", summary.FailedClosers)
+	}
+}
+
+func TestTruncatedContent(t *testing.T) {
+	p, _ := createMemoryProcessor()
+	p.contentTypesToKeep = []string{"text"}
+	now := time.Now()
+	headers := []string{"Content-Type: text/plain"}
+	entry := p.convert(core.HttpTransaction{
+		Request: core.HttpRequest{
+			HttpEntry: core.HttpEntry{Time: &now, Data: "0123", OriginalSize: 10, Truncated: true, Headers: headers},
+			Method:    "POST",
+		},
+		Response: &core.HttpResponse{
+			HttpEntry: core.HttpEntry{Time: &now, Data: "ok", Headers: headers},
+			Code:      200,
+		},
+	})
+
+	request := entry.Request
+	if request.BodySize != 10 || !request.PostData.Truncated || request.PostData.OriginalSize != 10 || request.PostData.Text != "0123" {
+		t.Fatalf("wrong truncated request %+v", request)
+	}
+	response := entry.Response
+	if response.BodySize != 2 || response.Content.Truncated || response.Content.OriginalSize != 0 {
+		t.Fatalf("wrong response %+v", response)
+	}
+}
+
+func TestQueryString(t *testing.T) {
+	p, _ := createMemoryProcessor()
+	pairs := p.getQueryString("z=1&id=2&a&id=3&&name=a%20b&bad=%zz")
+
+	var parts []string
+	for _, pair := range pairs {
+		parts = append(parts, pair.Name+"="+pair.Value)
+	}
+	query := strings.Join(parts, "&")
+	if query != "z=1&id=2&a=&id=3&name=a b&bad=%zz" {
+		t.Fatalf("wrong query string %v", query)
+	}
+}
+
+func TestHarCompliance(t *testing.T) {
+	p, _ := createMemoryProcessor()
+	now := time.Now()
+	entries := []har.Entry{
+		p.convert(core.HttpTransaction{
+			Request: core.HttpRequest{
+				HttpEntry: core.HttpEntry{Time: &now, Data: "a=1", Version: "HTTP/1.1",
+					Headers: []string{"Host: example.com", "Content-Type: application/x-www-form-urlencoded", "Cookie: id=1; theme=dark"}},
+				Method: "POST",
+				Path:   "/items",
+				Query:  "id=2",
+			},
+			Response: &core.HttpResponse{
+				HttpEntry: core.HttpEntry{Time: &now, Version: "HTTP/1.1", Headers: []string{
+					"Location: /items/2",
+					"Set-Cookie: session=abc; Path=/; Max-Age=60; HttpOnly; Secure; SameSite=Lax",
+				}},
+				Code: 302,
+			},
+		}),
+		// a request without a host header or a response
+		p.convert(core.HttpTransaction{
+			Request: core.HttpRequest{
+				HttpEntry:     core.HttpEntry{Time: &now, Version: "HTTP/1.0"},
+				Method:        "GET",
+				Path:          "/",
+				HttpIpAndPort: core.HttpIpAndPort{DstIP: "2001:db8::1", DstPort: 8080},
+			},
+		}),
+	}
+
+	data, err := json.Marshal(p.getHarFile(entries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	violations, err := har.Validate(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) != 0 {
+		t.Fatalf("expected no violations, but got %q", violations)
+	}
+
+	first := entries[0]
+	if first.Request.Url != "http://example.com/items?id=2" || first.Response.StatusText != "Found" ||
+		first.Response.RedirectUrl != "/items/2" || first.Request.PostData.MimeType != "application/x-www-form-urlencoded" {
+		t.Fatalf("wrong entry %+v", first)
+	}
+	if len(first.Request.Cookies) != 2 || len(first.Response.Cookies) != 1 || first.Response.Cookies[0].SameSite != "Lax" {
+		t.Fatalf("wrong cookies %+v %+v", first.Request.Cookies, first.Response.Cookies)
+	}
+	if entries[1].Request.Url != "http://[2001:db8::1]:8080/" || entries[1].Request.PostData != nil {
+		t.Fatalf("wrong entry without host %+v", entries[1])
+	}
+	if first.Started != now.UTC().Format("2006-01-02T15:04:05.000Z") {
+		t.Fatalf("wrong started %v", first.Started)
+	}
+}
+
+func TestDroppedContent(t *testing.T) {
+	initDecoding()
+	p, _ := createMemoryProcessor()
+	p.contentTypesToKeep = []string{"json"}
+	now := time.Now()
+	png := "\x89PNG\r\n\x1a\n\x00\x00"
+	entry := p.convert(core.HttpTransaction{
+		Request: core.HttpRequest{
+			HttpEntry: core.HttpEntry{Time: &now, Data: "a=1", Headers: []string{"Content-Type: application/x-www-form-urlencoded"}},
+			Method:    "POST",
+		},
+		Response: &core.HttpResponse{
+			HttpEntry: core.HttpEntry{Time: &now, Data: png, Headers: []string{"Content-Type: image/png"}},
+			Code:      200,
+		},
+	})
+	postData := entry.Request.PostData
+	if postData.Text != "a=1" || len(postData.Params) != 1 || postData.Params[0].Name != "a" || postData.Params[0].Value != "1" {
+		t.Fatalf("request body should had been kept regardless of the content type %+v", postData)
+	}
+	content := entry.Response.Content
+	if content.Text != "" || content.Encoding != "" || content.Size != len(png) {
+		t.Fatalf("response body should had been dropped %+v", content)
+	}
+
+	// a kept response body is not affected by the request content type
+	entry = p.convert(core.HttpTransaction{
+		Request: core.HttpRequest{
+			HttpEntry: core.HttpEntry{Time: &now, Data: "a=1", Headers: []string{"Content-Type: application/x-www-form-urlencoded"}},
+			Method:    "POST",
+		},
+		Response: &core.HttpResponse{
+			HttpEntry: core.HttpEntry{Time: &now, Data: "{}", Headers: []string{"Content-Type: application/json"}},
+			Code:      200,
+		},
+	})
+	if entry.Request.PostData.Text != "a=1" || entry.Response.Content.Text != "{}" {
+		t.Fatalf("wrong kept bodies %+v %+v", entry.Request.PostData, entry.Response.Content)
+	}
+}
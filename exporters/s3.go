@@ -21,10 +21,11 @@ type Reason int
 const (
 	Size Reason = iota
 	Time
+	Final
 )
 
 func (r Reason) String() string {
-	return []string{"S", "T"}[r]
+	return []string{"S", "T", "F"}[r]
 }
 
 type S3Client struct {
@@ -156,6 +157,15 @@ func (s *S3Client) getNumOfEntries() int {
 	return numOfEntries
 }
 
+// Close exports the held entries, so they are not lost when the process terminates
+func (s *S3Client) Close() error {
+	err := s.doExportWrapper(Final)
+	if err != nil {
+		return fmt.Errorf("failed to export har data: %v", err)
+	}
+	return nil
+}
+
 func (s *S3Client) doExportWrapper(reason Reason) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -35,6 +35,17 @@ type SingleSiteStats struct {
 	responsesStats          SizesStats
 	transactionsStats       SizesStats
 	requestsWithoutResponse int
+	tcpStats                TcpStats
+}
+
+// TcpStats sums the TCP metrics of the transactions.
+// The handshake RTT is set only on the first transaction of each connection, so its average is per connection.
+type TcpStats struct {
+	retransmissions   int
+	outOfOrder        int
+	zeroWindows       int
+	handshakeRttSum   float64
+	handshakeRttCount int
 }
 
 func (s *SitesStats) init() {
@@ -75,6 +86,7 @@ func (s *SitesStats) Process(harData *har.Har) error {
 	s.totalStats.totalSize += uint64(dataLen)
 	s.totalStats.totalTransactions += uint64(len(harData.Log.Entries))
 	s.updateSizesStats(&s.totalStats, harData)
+	s.updateTcpStats(&s.totalStats.tcpStats, harData)
 
 	if core.Config.SplitByAppId {
 		appId := harData.Log.Entries[0].GetAppId()
@@ -82,12 +94,19 @@ func (s *SitesStats) Process(harData *har.Har) error {
 		appIdStats.totalSize += uint64(dataLen)
 		appIdStats.totalTransactions += uint64(len(harData.Log.Entries))
 		s.updateSizesStats(&appIdStats, harData)
+		s.updateTcpStats(&appIdStats.tcpStats, harData)
 		s.hostsStats[appId] = appIdStats
 	}
 
 	return nil
 }
 
+// Close prints the statistics of the transactions exported since the last print
+func (s *SitesStats) Close() error {
+	s.print()
+	return nil
+}
+
 func (s *SitesStats) print() {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -103,6 +122,7 @@ func (s *SitesStats) print() {
 	titles += s.getSizesTitles("request")
 	titles += s.getSizesTitles("response")
 	titles += s.getSizesTitles("transaction")
+	titles += ",Retransmissions,OutOfOrder,ZeroWindows,AverageHandshakeRttMs"
 	messages = append(messages, titles)
 
 	message := s.printSingle("__Summary__", s.totalStats)
@@ -116,7 +136,7 @@ func (s *SitesStats) print() {
 
 	err := core.SaveToFile(core.Config.SitesStatsFile, strings.Join(messages, "\n"))
 	if err != nil {
-		s.Logger.Warn("create statistics file failed: %v", err)
+		s.Logger.Warn(fmt.Sprintf("create statistics file failed: %v", err))
 		return
 	}
 }
@@ -135,7 +155,7 @@ func (s *SitesStats) printSingle(name string, stats SingleSiteStats) string {
 	bps := float32(stats.totalSize) / float32(runSeconds)
 	tps := float32(stats.totalTransactions) / float32(runSeconds)
 	avgSize := float32(stats.totalSize) / float32(stats.totalTransactions)
-	return fmt.Sprintf("%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v",
+	return fmt.Sprintf("%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v",
 		name,
 		runSeconds,
 		stats.totalSize,
@@ -147,9 +167,33 @@ func (s *SitesStats) printSingle(name string, stats SingleSiteStats) string {
 		s.printSizesStats(stats.requestsStats),
 		s.printSizesStats(stats.responsesStats),
 		s.printSizesStats(stats.transactionsStats),
+		s.printTcpStats(stats.tcpStats),
 	)
 }
 
+func (s *SitesStats) printTcpStats(stats TcpStats) string {
+	averageRtt := "NA"
+	if stats.handshakeRttCount > 0 {
+		averageRtt = fmt.Sprintf("%.3f", stats.handshakeRttSum/float64(stats.handshakeRttCount))
+	}
+	return fmt.Sprintf("%v,%v,%v,%v", stats.retransmissions, stats.outOfOrder, stats.zeroWindows, averageRtt)
+}
+
+func (s *SitesStats) updateTcpStats(stats *TcpStats, data *har.Har) {
+	for _, entry := range data.Log.Entries {
+		if entry.TCP == nil {
+			continue
+		}
+		stats.retransmissions += entry.TCP.Retransmissions
+		stats.outOfOrder += entry.TCP.OutOfOrder
+		stats.zeroWindows += entry.TCP.ZeroWindows
+		if entry.TCP.HandshakeRTT >= 0 {
+			stats.handshakeRttSum += entry.TCP.HandshakeRTT
+			stats.handshakeRttCount++
+		}
+	}
+}
+
 func (s *SitesStats) printSizesStats(stats SizesStats) string {
 	var line string
 	if stats.min == nil || stats.max == nil {
@@ -0,0 +1,58 @@
+package exporters
+
+import (
+	"github.com/alonana/httshark/core"
+	"github.com/alonana/httshark/har"
+	"math"
+	"time"
+)
+
+// getTimings returns the send, wait and receive times of the transaction.
+// The send is from the first to the last request byte, the wait is from the last request byte to the first response byte,
+// and the receive is from the first to the last response byte.
+// tshark reports a single time for each entry, so its send and receive are 0, and its wait is between the request and the response.
+func getTimings(request core.HttpRequest, response *core.HttpResponse) har.Timings {
+	requestEnd := getEndTime(request.HttpEntry)
+	timings := har.Timings{
+		Send: milliseconds(requestEnd.Sub(*request.Time)),
+	}
+	if response != nil {
+		timings.Wait = milliseconds(response.Time.Sub(requestEnd))
+		timings.Receive = milliseconds(getEndTime(response.HttpEntry).Sub(*response.Time))
+	}
+	return timings
+}
+
+func getEndTime(entry core.HttpEntry) time.Time {
+	if entry.EndTime == nil || entry.EndTime.Before(*entry.Time) {
+		return *entry.Time
+	}
+	return *entry.EndTime
+}
+
+// milliseconds returns the duration in milliseconds, rounded to microseconds.
+// Negative durations, caused by an out of order capture, are reported as 0.
+func milliseconds(duration time.Duration) float64 {
+	if duration < 0 {
+		return 0
+	}
+	return math.Round(float64(duration)/float64(time.Microsecond)) / 1000
+}
+
+func getTCPMetrics(metrics *core.HttpTcpMetrics) *har.TCPMetrics {
+	handshakeRTT := float64(-1)
+	if metrics.HandshakeRTT > 0 {
+		handshakeRTT = milliseconds(metrics.HandshakeRTT)
+	}
+	return &har.TCPMetrics{
+		Retransmissions: metrics.Retransmissions,
+		OutOfOrder:      metrics.OutOfOrder,
+		ZeroWindows:     metrics.ZeroWindows,
+		HandshakeRTT:    handshakeRTT,
+	}
+}
+
+// totalTime returns the entry time, the sum of the timings
+func totalTime(timings har.Timings) float64 {
+	return math.Round((timings.Send+timings.Wait+timings.Receive)*1000) / 1000
+}
@@ -0,0 +1,35 @@
+package exporters
+
+import (
+	"github.com/alonana/httshark/core"
+	"github.com/alonana/httshark/har"
+	"testing"
+	"time"
+)
+
+func TestTimings(t *testing.T) {
+	base := time.Unix(1000, 0)
+	requestEnd := base.Add(1500 * time.Microsecond)
+	responseStart := base.Add(20 * time.Millisecond)
+	responseEnd := base.Add(25 * time.Millisecond)
+
+	request := core.HttpRequest{HttpEntry: core.HttpEntry{Time: &base, EndTime: &requestEnd}}
+	response := &core.HttpResponse{HttpEntry: core.HttpEntry{Time: &responseStart, EndTime: &responseEnd}}
+	timings := getTimings(request, response)
+	if timings != (har.Timings{Send: 1.5, Wait: 18.5, Receive: 5}) || totalTime(timings) != 25 {
+		t.Fatalf("wrong timings %+v", timings)
+	}
+
+	// a single time per entry, as reported by tshark
+	request = core.HttpRequest{HttpEntry: core.HttpEntry{Time: &base}}
+	response = &core.HttpResponse{HttpEntry: core.HttpEntry{Time: &responseEnd}}
+	timings = getTimings(request, response)
+	if timings != (har.Timings{Wait: 25}) {
+		t.Fatalf("wrong single time timings %+v", timings)
+	}
+
+	timings = getTimings(request, nil)
+	if timings != (har.Timings{}) {
+		t.Fatalf("wrong timings without a response %+v", timings)
+	}
+}
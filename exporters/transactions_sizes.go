@@ -46,6 +46,12 @@ func (s *TransactionsSizes) Process(harData *har.Har) error {
 	return nil
 }
 
+// Close prints the sizes of the transactions exported since the last print
+func (s *TransactionsSizes) Close() error {
+	s.print()
+	return nil
+}
+
 func (s *TransactionsSizes) print() {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -3,9 +3,13 @@ module github.com/alonana/httshark
 go 1.12
 
 require (
+	github.com/andybalholm/brotli v1.0.4
 	github.com/google/gopacket v1.1.17
 	github.com/hsiafan/glow v1.1.3
 	github.com/hsiafan/vlog v0.6.0
+	github.com/klauspost/compress v1.18.0
 	github.com/namsral/flag v1.7.4-pre
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
+	golang.org/x/net v0.0.0-20191126235420-ef20fe5d7933
 	golang.org/x/text v0.3.2
 )
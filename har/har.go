@@ -2,18 +2,33 @@ package har
 
 import (
 	"fmt"
+	"strings"
 )
 
+// Cookie is a request cookie, or a response cookie with its attributes.
+// Expires is in ISO 8601 format, or the original value if it cannot be parsed.
+// SameSite is the SameSite attribute, as exported by the browsers.
 type Cookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HttpOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+	SameSite string `json:"sameSite,omitempty"`
 }
 
+// Cache is empty, as the cache state of the client is unknown to a network capture
 type Cache struct {
 }
 
+// Timings are in milliseconds.
+// Wait is the time to first byte, from the last request byte to the first response byte.
 type Timings struct {
-	Send    int `json:"send"`
-	Wait    int `json:"wait"`
-	Receive int `json:"receive"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
 }
 
 type Pair struct {
@@ -21,10 +36,40 @@ type Pair struct {
 	Value string `json:"value"`
 }
 
+// Content is the decoded body.
+// ContentEncoding is a custom field that keeps the original content and transfer codings of the body.
+// Truncated is a custom field set when the body was above the max body size, and only its first bytes were kept.
+// OriginalSize is a custom field that keeps the size of a truncated body as it was sent.
+// Encoding is base64 for a binary body, whose text is base64 encoded.
 type Content struct {
-	Size     int    `json:"size"`
-	MimeType string `json:"mimeType"`
-	Text     string `json:"text"`
+	Size            int    `json:"size"`
+	Compression     int    `json:"compression,omitempty"`
+	MimeType        string `json:"mimeType"`
+	Text            string `json:"text"`
+	Encoding        string `json:"encoding,omitempty"`
+	ContentEncoding string `json:"_contentEncoding,omitempty"`
+	Truncated       bool   `json:"_truncated,omitempty"`
+	OriginalSize    int    `json:"_originalSize,omitempty"`
+}
+
+// Param is a posted parameter of a URL encoded or a multipart body
+type Param struct {
+	Name        string `json:"name"`
+	Value       string `json:"value,omitempty"`
+	FileName    string `json:"fileName,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+// PostData is the decoded request body.
+// The custom fields are the same as the fields of the Content, as HAR has no encoding for the post data.
+type PostData struct {
+	MimeType        string  `json:"mimeType"`
+	Params          []Param `json:"params"`
+	Text            string  `json:"text"`
+	Encoding        string  `json:"_encoding,omitempty"`
+	ContentEncoding string  `json:"_contentEncoding,omitempty"`
+	Truncated       bool    `json:"_truncated,omitempty"`
+	OriginalSize    int     `json:"_originalSize,omitempty"`
 }
 
 type AppIdentifier struct {
@@ -36,43 +81,95 @@ func (a *AppIdentifier) Empty() {
 	a.DstPort = 0
 }
 
+// String returns the app id as IP_port, where an IPv6 IP is bracketed
 func (a *AppIdentifier) String() string {
+	if strings.Contains(a.DstIP, ":") {
+		return fmt.Sprintf("[%s]_%d", a.DstIP, a.DstPort)
+	}
 	return fmt.Sprintf("%s_%d", a.DstIP, a.DstPort)
 }
 
+// FileName returns the app id in a form that can be used as part of a file name,
+// replacing the colons of an IPv6 IP with dashes
+func (a *AppIdentifier) FileName() string {
+	return fmt.Sprintf("%s_%d", strings.Replace(a.DstIP, ":", "-", -1), a.DstPort)
+}
+
+// Request is the HAR request.
+// Url is the absolute URL, including the query string.
+// PostData is missing when the request has no body.
+// AppId is a custom field that identifies the application of the request, by its destination.
 type Request struct {
 	Method      string         `json:"method"`
 	Url         string         `json:"url"`
 	HttpVersion string         `json:"httpVersion"`
+	Cookies     []Cookie       `json:"cookies"`
 	Headers     []Pair         `json:"headers"`
 	QueryString []Pair         `json:"queryString"`
-	Cookies     []Cookie       `json:"cookies"`
+	PostData    *PostData      `json:"postData,omitempty"`
 	HeadersSize int            `json:"headersSize"`
 	BodySize    int            `json:"bodySize"`
-	Content     Content        `json:"content"`
-	AppId       *AppIdentifier `json:"appId,omitempty"`
+	AppId       *AppIdentifier `json:"_appId,omitempty"`
 }
 
+// Response is the HAR response.
+// Exists is a custom field, which is false when the response was not captured.
 type Response struct {
-	Exists      bool     `json:"exists"`
 	Status      int      `json:"status"`
 	StatusText  string   `json:"statusText"`
 	HttpVersion string   `json:"httpVersion"`
-	RedirectUrl string   `json:"redirectURL"`
+	Cookies     []Cookie `json:"cookies"`
 	Headers     []Pair   `json:"headers"`
+	Content     Content  `json:"content"`
+	RedirectUrl string   `json:"redirectURL"`
 	HeadersSize int      `json:"headersSize"`
 	BodySize    int      `json:"bodySize"`
-	Cookies     []Cookie `json:"cookies"`
-	Content     Content  `json:"content"`
+	Exists      bool     `json:"_exists"`
+}
+
+// Tunnel is the outer encapsulation of the entry, a custom field of the HAR entry
+type Tunnel struct {
+	Encapsulation []string `json:"encapsulation"`
+	VlanID        int      `json:"vlanId,omitempty"`
+	VNI           int      `json:"vni,omitempty"`
+	GreKey        int      `json:"greKey,omitempty"`
+	ErspanSession int      `json:"erspanSession,omitempty"`
+}
+
+// WebSocketMessage is a message of a WebSocket session, using the Chrome HAR format.
+// Time is the seconds since the epoch.
+type WebSocketMessage struct {
+	Type   string  `json:"type"`
+	Time   float64 `json:"time"`
+	Opcode int     `json:"opcode"`
+	Data   string  `json:"data"`
+}
+
+// TCPMetrics are the TCP quality metrics of the transaction connection.
+// HandshakeRTT is in milliseconds, -1 when the handshake was not captured, or on the next transactions of the connection.
+type TCPMetrics struct {
+	Retransmissions int     `json:"retransmissions"`
+	OutOfOrder      int     `json:"outOfOrder"`
+	ZeroWindows     int     `json:"zeroWindows"`
+	HandshakeRTT    float64 `json:"handshakeRtt"`
 }
 
 type Entry struct {
 	Started  string   `json:"startedDateTime"`
-	Time     int      `json:"time"`
+	Time     float64  `json:"time"`
 	Request  Request  `json:"request"`
 	Response Response `json:"response"`
+	Cache    Cache    `json:"cache"`
 	Timings  Timings  `json:"timings"`
-	Cache    Timings  `json:"cache"`
+	Tunnel   *Tunnel  `json:"_tunnel,omitempty"`
+
+	ServerIPAddress string `json:"serverIPAddress,omitempty"`
+	Connection      string `json:"connection,omitempty"`
+	ClientIPAddress string `json:"_clientIPAddress,omitempty"`
+
+	WebSocketMessages []WebSocketMessage `json:"_webSocketMessages,omitempty"`
+	TCP               *TCPMetrics        `json:"_tcp,omitempty"`
+	BodiesDropped     bool               `json:"_bodiesDropped,omitempty"`
 }
 
 type Creator struct {
@@ -94,3 +191,7 @@ func (e Entry) GetAppId() string {
 	return e.Request.AppId.String()
 }
 
+func (e Entry) GetAppIdFileName() string {
+	return e.Request.AppId.FileName()
+}
+
@@ -0,0 +1,337 @@
+package har
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const kindString = "string"
+const kindNumber = "number"
+const kindBool = "boolean"
+const kindObject = "object"
+const kindArray = "array"
+
+// field describes a field of a HAR object.
+// The object is the schema name of an object field, or of the items of an array field.
+type field struct {
+	kind     string
+	required bool
+	object   string
+}
+
+var comment = field{kind: kindString}
+
+// schemas are the fields of the HAR 1.2 objects, by the object name
+var schemas = map[string]map[string]field{
+	"har": {
+		"log": {kindObject, true, "log"},
+	},
+	"log": {
+		"version": {kindString, true, ""},
+		"creator": {kindObject, true, "creator"},
+		"browser": {kindObject, false, "creator"},
+		"pages":   {kindArray, false, "page"},
+		"entries": {kindArray, true, "entry"},
+		"comment": comment,
+	},
+	"creator": {
+		"name":    {kindString, true, ""},
+		"version": {kindString, true, ""},
+		"comment": comment,
+	},
+	"page": {
+		"startedDateTime": {kindString, true, ""},
+		"id":              {kindString, true, ""},
+		"title":           {kindString, true, ""},
+		"pageTimings":     {kindObject, true, "pageTimings"},
+		"comment":         comment,
+	},
+	"pageTimings": {
+		"onContentLoad": {kindNumber, false, ""},
+		"onLoad":        {kindNumber, false, ""},
+		"comment":       comment,
+	},
+	"entry": {
+		"pageref":         {kindString, false, ""},
+		"startedDateTime": {kindString, true, ""},
+		"time":            {kindNumber, true, ""},
+		"request":         {kindObject, true, "request"},
+		"response":        {kindObject, true, "response"},
+		"cache":           {kindObject, true, "cache"},
+		"timings":         {kindObject, true, "timings"},
+		"serverIPAddress": {kindString, false, ""},
+		"connection":      {kindString, false, ""},
+		"comment":         comment,
+	},
+	"request": {
+		"method":      {kindString, true, ""},
+		"url":         {kindString, true, ""},
+		"httpVersion": {kindString, true, ""},
+		"cookies":     {kindArray, true, "cookie"},
+		"headers":     {kindArray, true, "pair"},
+		"queryString": {kindArray, true, "pair"},
+		"postData":    {kindObject, false, "postData"},
+		"headersSize": {kindNumber, true, ""},
+		"bodySize":    {kindNumber, true, ""},
+		"comment":     comment,
+	},
+	"response": {
+		"status":      {kindNumber, true, ""},
+		"statusText":  {kindString, true, ""},
+		"httpVersion": {kindString, true, ""},
+		"cookies":     {kindArray, true, "cookie"},
+		"headers":     {kindArray, true, "pair"},
+		"content":     {kindObject, true, "content"},
+		"redirectURL": {kindString, true, ""},
+		"headersSize": {kindNumber, true, ""},
+		"bodySize":    {kindNumber, true, ""},
+		"comment":     comment,
+	},
+	"cookie": {
+		"name":     {kindString, true, ""},
+		"value":    {kindString, true, ""},
+		"path":     {kindString, false, ""},
+		"domain":   {kindString, false, ""},
+		"expires":  {kindString, false, ""},
+		"httpOnly": {kindBool, false, ""},
+		"secure":   {kindBool, false, ""},
+		"sameSite": {kindString, false, ""}, // not in the spec, but exported by the browsers
+		"comment":  comment,
+	},
+	"pair": {
+		"name":    {kindString, true, ""},
+		"value":   {kindString, true, ""},
+		"comment": comment,
+	},
+	"postData": {
+		"mimeType": {kindString, true, ""},
+		"params":   {kindArray, false, "param"},
+		"text":     {kindString, false, ""},
+		"comment":  comment,
+	},
+	"param": {
+		"name":        {kindString, true, ""},
+		"value":       {kindString, false, ""},
+		"fileName":    {kindString, false, ""},
+		"contentType": {kindString, false, ""},
+		"comment":     comment,
+	},
+	"content": {
+		"size":        {kindNumber, true, ""},
+		"compression": {kindNumber, false, ""},
+		"mimeType":    {kindString, true, ""},
+		"text":        {kindString, false, ""},
+		"encoding":    {kindString, false, ""},
+		"comment":     comment,
+	},
+	"cache": {
+		"beforeRequest": {kindObject, false, "cacheEntry"},
+		"afterRequest":  {kindObject, false, "cacheEntry"},
+		"comment":       comment,
+	},
+	"cacheEntry": {
+		"expires":    {kindString, false, ""},
+		"lastAccess": {kindString, true, ""},
+		"eTag":       {kindString, true, ""},
+		"hitCount":   {kindNumber, true, ""},
+		"comment":    comment,
+	},
+	"timings": {
+		"blocked": {kindNumber, false, ""},
+		"dns":     {kindNumber, false, ""},
+		"connect": {kindNumber, false, ""},
+		"send":    {kindNumber, true, ""},
+		"wait":    {kindNumber, true, ""},
+		"receive": {kindNumber, true, ""},
+		"ssl":     {kindNumber, false, ""},
+		"comment": comment,
+	},
+}
+
+// the optional timings, which are -1 when they do not apply
+var optionalTimings = []string{"blocked", "dns", "connect", "ssl"}
+
+type validator struct {
+	violations []string
+}
+
+// Validate checks the HAR file data against the HAR 1.2 spec, and returns the spec violations.
+// Each violation starts with the JSON path of the invalid value.
+// An error is returned only when the data is not JSON.
+func Validate(data []byte) ([]string, error) {
+	var root interface{}
+	err := json.Unmarshal(data, &root)
+	if err != nil {
+		return nil, fmt.Errorf("parse json failed: %v", err)
+	}
+	v := validator{}
+	v.object("", root, "har")
+	return v.violations, nil
+}
+
+func (v *validator) add(path string, format string, args ...interface{}) {
+	if path == "" {
+		path = "root"
+	}
+	v.violations = append(v.violations, path+": "+fmt.Sprintf(format, args...))
+}
+
+// object validates the fields of an object by its schema
+func (v *validator) object(path string, value interface{}, name string) {
+	values, ok := value.(map[string]interface{})
+	if !ok {
+		v.add(path, "expected %v, but got %v", kindObject, kindOf(value))
+		return
+	}
+
+	schema := schemas[name]
+	var names []string
+	for fieldName := range values {
+		names = append(names, fieldName)
+	}
+	sort.Strings(names)
+	for _, fieldName := range names {
+		if _, known := schema[fieldName]; !known && !strings.HasPrefix(fieldName, "_") {
+			v.add(joinPath(path, fieldName), "unknown field, custom fields must start with an underscore")
+		}
+	}
+
+	var fieldNames []string
+	for fieldName := range schema {
+		fieldNames = append(fieldNames, fieldName)
+	}
+	sort.Strings(fieldNames)
+	for _, fieldName := range fieldNames {
+		v.field(joinPath(path, fieldName), values, fieldName, schema[fieldName])
+	}
+
+	v.check(path, values, name)
+}
+
+func (v *validator) field(path string, values map[string]interface{}, name string, f field) {
+	value, exists := values[name]
+	if !exists || (value == nil && !f.required) {
+		if f.required {
+			v.add(path, "missing required field")
+		}
+		return
+	}
+
+	switch f.kind {
+	case kindObject:
+		v.object(path, value, f.object)
+	case kindArray:
+		items, ok := value.([]interface{})
+		if !ok {
+			v.add(path, "expected %v, but got %v", kindArray, kindOf(value))
+			return
+		}
+		for i, item := range items {
+			v.object(fmt.Sprintf("%v[%v]", path, i), item, f.object)
+		}
+	default:
+		if kindOf(value) != f.kind {
+			v.add(path, "expected %v, but got %v", f.kind, kindOf(value))
+		}
+	}
+}
+
+// check validates the values of the object fields, beyond their types
+func (v *validator) check(path string, values map[string]interface{}, name string) {
+	switch name {
+	case "log":
+		if version, ok := values["version"].(string); ok && version != "1.2" {
+			v.add(joinPath(path, "version"), "expected version 1.2, but got %q", version)
+		}
+	case "page":
+		v.checkDate(path, values, "startedDateTime")
+	case "entry":
+		v.checkDate(path, values, "startedDateTime")
+		v.checkEntryTime(path, values)
+	case "request":
+		if rawUrl, ok := values["url"].(string); ok {
+			parsed, err := url.Parse(rawUrl)
+			if err != nil || !parsed.IsAbs() || parsed.Host == "" {
+				v.add(joinPath(path, "url"), "%q is not an absolute URL", rawUrl)
+			}
+		}
+	case "response":
+		if status, ok := values["status"].(float64); ok && status != math.Trunc(status) {
+			v.add(joinPath(path, "status"), "expected an integer, but got %v", status)
+		}
+	case "timings":
+		for _, timing := range []string{"send", "wait", "receive"} {
+			if value, ok := values[timing].(float64); ok && value < 0 {
+				v.add(joinPath(path, timing), "expected a non negative time, but got %v", value)
+			}
+		}
+		for _, timing := range optionalTimings {
+			if value, ok := values[timing].(float64); ok && value < -1 {
+				v.add(joinPath(path, timing), "expected a non negative time or -1, but got %v", value)
+			}
+		}
+	}
+}
+
+func (v *validator) checkDate(path string, values map[string]interface{}, name string) {
+	value, ok := values[name].(string)
+	if !ok {
+		return
+	}
+	_, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		v.add(joinPath(path, name), "%q is not an ISO 8601 date", value)
+	}
+}
+
+// checkEntryTime verifies that the entry time is the sum of its available timings
+func (v *validator) checkEntryTime(path string, values map[string]interface{}) {
+	total, ok := values["time"].(float64)
+	if !ok {
+		return
+	}
+	timings, ok := values["timings"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	// the ssl time is included in the connect time
+	sum := float64(0)
+	for _, timing := range []string{"blocked", "dns", "connect", "send", "wait", "receive"} {
+		if value, ok := timings[timing].(float64); ok && value > 0 {
+			sum += value
+		}
+	}
+	// allow the rounding of the timings
+	if math.Abs(total-sum) > 0.01 {
+		v.add(joinPath(path, "time"), "expected the sum of the timings %v, but got %v", sum, total)
+	}
+}
+
+func joinPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func kindOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return kindString
+	case float64:
+		return kindNumber
+	case bool:
+		return kindBool
+	case []interface{}:
+		return kindArray
+	default:
+		return kindObject
+	}
+}
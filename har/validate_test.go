@@ -0,0 +1,71 @@
+package har
+
+import (
+	"strings"
+	"testing"
+)
+
+const validHar = `{
+  "log": {
+    "version": "1.2",
+    "creator": {"name": "httshark", "version": "1.0"},
+    "entries": [{
+      "startedDateTime": "2020-04-06T09:37:42.123Z",
+      "time": 3.5,
+      "request": {
+        "method": "POST", "url": "http://example.com/items?a=1", "httpVersion": "HTTP/1.1",
+        "cookies": [{"name": "id", "value": "1"}], "headers": [{"name": "Host", "value": "example.com"}],
+        "queryString": [{"name": "a", "value": "1"}],
+        "postData": {"mimeType": "text/plain", "params": [], "text": "body", "_truncated": true},
+        "headersSize": 17, "bodySize": 4, "_appId": {"dstIp": "10.0.0.1", "dstPort": 80}
+      },
+      "response": {
+        "status": 200, "statusText": "OK", "httpVersion": "HTTP/1.1", "cookies": [], "headers": [],
+        "content": {"size": 0, "mimeType": ""}, "redirectURL": "", "headersSize": -1, "bodySize": 0
+      },
+      "cache": {},
+      "timings": {"blocked": -1, "send": 1, "wait": 2, "receive": 0.5}
+    }]
+  }
+}`
+
+func TestValidate(t *testing.T) {
+	violations, err := Validate([]byte(validHar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) != 0 {
+		t.Fatalf("expected no violations, but got %q", violations)
+	}
+}
+
+func TestValidateViolations(t *testing.T) {
+	data := strings.Replace(validHar, `"http://example.com/items?a=1"`, `"/items"`, 1)
+	data = strings.Replace(data, `"statusText": "OK", `, `"exists": true, `, 1)
+	data = strings.Replace(data, `"cache": {}`, `"cache": {"send": 0}`, 1)
+	data = strings.Replace(data, `"2020-04-06T09:37:42.123Z"`, `"2020-04-06 09:37:42"`, 1)
+	data = strings.Replace(data, `"time": 3.5`, `"time": 4`, 1)
+
+	violations, err := Validate([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`log.entries[0].cache.send: unknown field, custom fields must start with an underscore`,
+		`log.entries[0].request.url: "/items" is not an absolute URL`,
+		`log.entries[0].response.exists: unknown field, custom fields must start with an underscore`,
+		`log.entries[0].response.statusText: missing required field`,
+		`log.entries[0].startedDateTime: "2020-04-06 09:37:42" is not an ISO 8601 date`,
+		`log.entries[0].time: expected the sum of the timings 3.5, but got 4`,
+	}
+	if strings.Join(violations, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("wrong violations %q", violations)
+	}
+}
+
+func TestValidateNotJson(t *testing.T) {
+	_, err := Validate([]byte("not json"))
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+}
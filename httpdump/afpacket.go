@@ -0,0 +1,238 @@
+//go:build linux
+// +build linux
+
+package httpdump
+
+import (
+	"fmt"
+	"github.com/alonana/httshark/core"
+	"github.com/alonana/httshark/core/aggregated"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/bpf"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the poll timeout of the ring, used to check for stop while no packets arrive
+const afpacketPollTimeout = 100 * time.Millisecond
+const afpacketSnapLength = 65536
+
+func init() {
+	core.RegisterCaptureEngine("afpacket", func(logger *logrus.Logger) core.CaptureEngine {
+		return &AfpacketEngine{Logger: logger}
+	})
+}
+
+// AfpacketEngine captures packets using AF_PACKET TPACKET_V3 memory mapped rings.
+// Each interface is captured by several sockets joined to a fanout group,
+// so the kernel hashes each flow to a single worker, and the workers assemble their flows in parallel.
+type AfpacketEngine struct {
+	Logger      *logrus.Logger
+	workers     []*afpacketWorker
+	stopChannel chan bool
+	running     sync.WaitGroup
+	done        chan bool
+}
+
+type afpacketWorker struct {
+	device    string
+	tpacket   *afpacket.TPacket
+	assembler *TCPAssembler
+	captured  uint64
+	flushed   int // the connections flushed when the worker stopped
+}
+
+func (e *AfpacketEngine) Start(p core.TransactionProcessor) error {
+	processor = p
+	filter, err := getAfpacketFilter()
+	if err != nil {
+		return fmt.Errorf("compile capture filter failed: %v", err)
+	}
+
+	fanoutGroup := core.Config.AfpacketFanoutGroup
+	if fanoutGroup == 0 {
+		fanoutGroup = os.Getpid()
+	}
+
+	// a fanout group is bound to a single interface, so each interface gets its own group
+	for i, device := range core.Devices() {
+		group := uint16(fanoutGroup + i)
+		for w := 0; w < core.Config.AfpacketWorkers; w++ {
+			worker, err := newAfpacketWorker(device, group, filter)
+			if err != nil {
+				e.close()
+				return fmt.Errorf("open afpacket socket on device %v failed: %v", device, err)
+			}
+			e.workers = append(e.workers, worker)
+		}
+		core.V1("afpacket capture on device %v using fanout group %v", device, group)
+	}
+
+	e.stopChannel = make(chan bool)
+	e.done = make(chan bool)
+	for _, worker := range e.workers {
+		e.running.Add(1)
+		go worker.run(e.stopChannel, &e.running)
+	}
+	return nil
+}
+
+func newAfpacketWorker(device string, fanoutGroup uint16, filter []bpf.RawInstruction) (*afpacketWorker, error) {
+	options := []interface{}{
+		afpacket.TPacketVersion3,
+		afpacket.OptBlockSize(core.Config.AfpacketBlockSize),
+		afpacket.OptNumBlocks(core.Config.AfpacketBlockCount),
+		afpacket.OptPollTimeout(afpacketPollTimeout),
+		// the kernel strips the 802.1Q tag, so add it back to the packet data for the decapsulation
+		afpacket.OptAddVLANHeader(true),
+	}
+	if device != "any" {
+		options = append(options, afpacket.OptInterface(device))
+	}
+
+	tpacket, err := afpacket.NewTPacket(options...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tpacket.SetBPF(filter)
+	if err != nil {
+		tpacket.Close()
+		return nil, fmt.Errorf("set capture filter failed: %v", err)
+	}
+
+	err = tpacket.SetFanout(afpacket.FanoutHash, fanoutGroup)
+	if err != nil {
+		tpacket.Close()
+		return nil, fmt.Errorf("join fanout group %v failed: %v", fanoutGroup, err)
+	}
+
+	return &afpacketWorker{
+		device:    device,
+		tpacket:   tpacket,
+		assembler: newTCPAssembler(),
+	}, nil
+}
+
+// getAfpacketFilter compiles the hosts filter to the raw BPF instructions of the afpacket socket
+func getAfpacketFilter() ([]bpf.RawInstruction, error) {
+	filter := getCaptureFilter()
+	core.V2("filter is %v", filter)
+	instructions, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, afpacketSnapLength, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]bpf.RawInstruction, len(instructions))
+	for i, instruction := range instructions {
+		raw[i] = bpf.RawInstruction{
+			Op: instruction.Code,
+			Jt: instruction.Jt,
+			Jf: instruction.Jf,
+			K:  instruction.K,
+		}
+	}
+	return raw, nil
+}
+
+// run the worker packets loop until the stop channel is closed
+func (w *afpacketWorker) run(stopChannel chan bool, running *sync.WaitGroup) {
+	defer running.Done()
+	var flushInterval = time.Second * 10
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopChannel:
+			w.flushed = w.assembler.flushAll()
+			return
+		case <-ticker.C:
+			core.V2("flush older")
+			w.assembler.flushOlderThan(time.Now().Add(-core.Config.ResponseTimeout))
+		default:
+		}
+
+		data, captureInfo, err := w.tpacket.ReadPacketData()
+		if err == afpacket.ErrTimeout {
+			continue
+		}
+		if err != nil {
+			aggregated.Warn("read afpacket packet from %v failed: %v", w.device, core.LimitedError(err))
+			continue
+		}
+
+		atomic.AddUint64(&w.captured, 1)
+		packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		packet.Metadata().CaptureInfo = captureInfo
+		assemblePacket(w.assembler, packet)
+	}
+}
+
+// Stop the workers, and wait for the in progress connections to report their transactions
+func (e *AfpacketEngine) Stop() core.FlushStats {
+	select {
+	case <-e.done:
+		return core.FlushStats{}
+	default:
+	}
+
+	close(e.stopChannel)
+	e.running.Wait()
+	waitForHandlers()
+
+	var flushed core.FlushStats
+	for _, worker := range e.workers {
+		flushed.Connections += worker.flushed
+	}
+
+	for _, stats := range e.Stats() {
+		e.Logger.Info(fmt.Sprintf("interface %v captured %v packets (received: %v, dropped: %v, queue freezes: %v)",
+			stats.Interface, stats.Captured, stats.Received, stats.Dropped, stats.Freezes))
+	}
+	e.close()
+	close(e.done)
+	return flushed
+}
+
+func (e *AfpacketEngine) close() {
+	for _, worker := range e.workers {
+		worker.tpacket.Close()
+	}
+}
+
+func (e *AfpacketEngine) Done() <-chan bool {
+	return e.done
+}
+
+// Stats returns the socket counters, summed for all the workers of each interface
+func (e *AfpacketEngine) Stats() []core.CaptureStats {
+	var allStats []core.CaptureStats
+	devicesIndex := make(map[string]int)
+	for _, worker := range e.workers {
+		index, exists := devicesIndex[worker.device]
+		if !exists {
+			index = len(allStats)
+			devicesIndex[worker.device] = index
+			allStats = append(allStats, core.CaptureStats{Interface: worker.device})
+		}
+		stats := &allStats[index]
+		stats.Captured += atomic.LoadUint64(&worker.captured)
+
+		_, socketStats, err := worker.tpacket.SocketStats()
+		if err != nil {
+			e.Logger.Warn(fmt.Sprintf("read socket stats of %v failed: %v", worker.device, err))
+			continue
+		}
+		stats.Received += uint64(socketStats.Packets())
+		stats.Dropped += uint64(socketStats.Drops())
+		stats.Freezes += uint64(socketStats.QueueFreezes())
+	}
+	return allStats
+}
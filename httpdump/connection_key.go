@@ -19,3 +19,8 @@ func (ck *ConnectionKey) srcString() string {
 func (ck *ConnectionKey) dstString() string {
 	return ck.dst.String()
 }
+
+// return the client and server endpoints, identifying the flow
+func (ck *ConnectionKey) String() string {
+	return ck.srcString() + "-" + ck.dstString()
+}
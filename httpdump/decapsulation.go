@@ -0,0 +1,141 @@
+package httpdump
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/alonana/httshark/core"
+	"github.com/alonana/httshark/core/aggregated"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"strings"
+)
+
+const vxlanPort = 4789
+const greProtocol = 47
+
+// ERSPAN is carried by GRE using these protocol types.
+// Type I uses the type II protocol, but without the GRE sequence number and without an ERSPAN header.
+const erspanTypeII = layers.EthernetType(0x88BE)
+const erspanTypeIII = layers.EthernetType(0x22EB)
+
+// getCaptureFilter wraps the hosts filter so it also matches the encapsulated packets.
+// The tunnels inner packets cannot be filtered by BPF, so the tunnels are captured,
+// and the inner packets are filtered by the assembler.
+func getCaptureFilter() string {
+	filter := getDevicesFilter()
+
+	var carriers []string
+	if core.IsDecapsulated("gre") {
+		carriers = append(carriers, fmt.Sprintf("ip proto %v or ip6 proto %v", greProtocol, greProtocol))
+	}
+	if core.IsDecapsulated("vxlan") {
+		carriers = append(carriers, fmt.Sprintf("udp port %v", vxlanPort))
+	}
+	if len(carriers) > 0 {
+		filter = fmt.Sprintf("(%v) or %v", filter, strings.Join(carriers, " or "))
+	}
+
+	// the vlan keyword moves the offsets of the rest of the filter past the 802.1Q tag
+	if core.IsDecapsulated("vlan") {
+		filter = fmt.Sprintf("(%v) or (vlan and (%v))", filter, filter)
+	}
+	return filter
+}
+
+// decapsulate locates the innermost IP and TCP layers of the packet, and collects the tunnels identifiers on the way.
+// The returned tcp layer is nil in case the packet is not tcp/ip, and the tunnel is nil in case the packet is not encapsulated.
+func decapsulate(packet gopacket.Packet) (gopacket.NetworkLayer, *layers.TCP, *core.HttpTunnel) {
+	var network gopacket.NetworkLayer
+	var tcp *layers.TCP
+	var tunnel *core.HttpTunnel
+
+	packetLayers := packet.Layers()
+	for i := 0; i < len(packetLayers); i++ {
+		switch layer := packetLayers[i].(type) {
+		case *layers.Dot1Q:
+			tunnel = addEncapsulation(tunnel, "vlan")
+			if tunnel.VlanID == 0 {
+				tunnel.VlanID = int(layer.VLANIdentifier)
+			}
+		case *layers.VXLAN:
+			tunnel = addEncapsulation(tunnel, "vxlan")
+			tunnel.VNI = int(layer.VNI)
+		case *layers.GRE:
+			tunnel = addEncapsulation(tunnel, "gre")
+			if layer.KeyPresent {
+				tunnel.GreKey = int(layer.Key)
+			}
+			if layer.Protocol != erspanTypeII && layer.Protocol != erspanTypeIII {
+				continue
+			}
+
+			frame, session, err := decodeErspan(layer)
+			if err != nil {
+				aggregated.Warn("decode ERSPAN failed: %v", err)
+				return nil, nil, nil
+			}
+			tunnel = addEncapsulation(tunnel, "erspan")
+			tunnel.ErspanSession = session
+
+			// restart the scan on the mirrored frame
+			packetLayers = gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.NoCopy).Layers()
+			i = -1
+		case *layers.IPv4:
+			network = layer
+			tcp = nil
+		case *layers.IPv6:
+			network = layer
+			tcp = nil
+		case *layers.TCP:
+			tcp = layer
+		}
+	}
+
+	if network == nil {
+		return nil, nil, nil
+	}
+	return network, tcp, tunnel
+}
+
+func addEncapsulation(tunnel *core.HttpTunnel, encapsulation string) *core.HttpTunnel {
+	if tunnel == nil {
+		tunnel = &core.HttpTunnel{}
+	}
+	tunnel.Encapsulation = append(tunnel.Encapsulation, encapsulation)
+	return tunnel
+}
+
+// decodeErspan returns the mirrored ethernet frame, and the ERSPAN session ID
+func decodeErspan(gre *layers.GRE) ([]byte, int, error) {
+	data := gre.LayerPayload()
+	if gre.Protocol == erspanTypeII && !gre.SeqPresent {
+		return data, 0, nil
+	}
+
+	headerLength := 8
+	if gre.Protocol == erspanTypeIII {
+		headerLength = 12
+	}
+	if len(data) < headerLength {
+		return nil, 0, fmt.Errorf("ERSPAN header truncated")
+	}
+
+	session := int(binary.BigEndian.Uint16(data[2:4]) & 0x3FF)
+
+	// type III might include an additional platform specific sub header
+	if gre.Protocol == erspanTypeIII && data[11]&0x01 != 0 {
+		headerLength += 8
+		if len(data) < headerLength {
+			return nil, 0, fmt.Errorf("ERSPAN platform sub header truncated")
+		}
+	}
+	return data[headerLength:], session, nil
+}
+
+// tunnelKey returns the tunnel identifiers, used to separate connections with the same endpoints in different tunnels
+func tunnelKey(tunnel *core.HttpTunnel) string {
+	if tunnel == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v/%v/%v/%v/", tunnel.VlanID, tunnel.VNI, tunnel.GreKey, tunnel.ErspanSession)
+}
@@ -0,0 +1,99 @@
+package httpdump
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"testing"
+)
+
+func TestDecapsulateVxlan(t *testing.T) {
+	inner := serialize(t,
+		&layers.Ethernet{SrcMAC: mac(1), DstMAC: mac(2), EthernetType: layers.EthernetTypeDot1Q},
+		&layers.Dot1Q{VLANIdentifier: 30, Type: layers.EthernetTypeIPv4},
+		innerIp(),
+		innerTcp(),
+		gopacket.Payload("GET / HTTP/1.1\r\n\r\n"),
+	)
+	data := serialize(t,
+		&layers.Ethernet{SrcMAC: mac(3), DstMAC: mac(4), EthernetType: layers.EthernetTypeIPv4},
+		&layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IP{192, 168, 0, 1}, DstIP: net.IP{192, 168, 0, 2}},
+		&layers.UDP{SrcPort: 50000, DstPort: vxlanPort},
+		&layers.VXLAN{ValidIDFlag: true, VNI: 5000},
+		gopacket.Payload(inner),
+	)
+
+	network, tcp, tunnel := decapsulate(gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default))
+	checkInner(t, network, tcp)
+	if tunnel == nil || tunnel.VNI != 5000 || tunnel.VlanID != 30 {
+		t.Fatalf("wrong tunnel %+v", tunnel)
+	}
+}
+
+func TestDecapsulateErspan(t *testing.T) {
+	frame := serialize(t,
+		&layers.Ethernet{SrcMAC: mac(1), DstMAC: mac(2), EthernetType: layers.EthernetTypeIPv4},
+		innerIp(),
+		innerTcp(),
+		gopacket.Payload("GET / HTTP/1.1\r\n\r\n"),
+	)
+	// version 1, session 7
+	erspan := []byte{0x10, 0x00, 0x00, 0x07, 0x00, 0x00, 0x00, 0x00}
+	data := serialize(t,
+		&layers.Ethernet{SrcMAC: mac(3), DstMAC: mac(4), EthernetType: layers.EthernetTypeIPv4},
+		&layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolGRE, SrcIP: net.IP{192, 168, 0, 1}, DstIP: net.IP{192, 168, 0, 2}},
+		&layers.GRE{SeqPresent: true, Seq: 1, Protocol: erspanTypeII},
+		gopacket.Payload(append(erspan, frame...)),
+	)
+
+	network, tcp, tunnel := decapsulate(gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default))
+	checkInner(t, network, tcp)
+	if tunnel == nil || tunnel.ErspanSession != 7 || len(tunnel.Encapsulation) != 2 {
+		t.Fatalf("wrong tunnel %+v", tunnel)
+	}
+}
+
+func TestDecapsulatePlain(t *testing.T) {
+	data := serialize(t,
+		&layers.Ethernet{SrcMAC: mac(1), DstMAC: mac(2), EthernetType: layers.EthernetTypeIPv4},
+		innerIp(),
+		innerTcp(),
+	)
+
+	network, tcp, tunnel := decapsulate(gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default))
+	checkInner(t, network, tcp)
+	if tunnel != nil {
+		t.Fatalf("unexpected tunnel %+v", tunnel)
+	}
+}
+
+func checkInner(t *testing.T, network gopacket.NetworkLayer, tcp *layers.TCP) {
+	if tcp == nil {
+		t.Fatalf("tcp layer not located")
+	}
+	if network.NetworkFlow().Dst().String() != "10.0.0.2" || tcp.DstPort != 80 {
+		t.Fatalf("wrong inner layers %v %v", network.NetworkFlow(), tcp.DstPort)
+	}
+}
+
+func innerIp() *layers.IPv4 {
+	return &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+}
+
+func innerTcp() *layers.TCP {
+	return &layers.TCP{SrcPort: 40000, DstPort: 80, Seq: 1, ACK: true, PSH: true, Window: 1000}
+}
+
+func mac(id byte) net.HardwareAddr {
+	return net.HardwareAddr{0, 0, 0, 0, 0, id}
+}
+
+func serialize(t *testing.T, serializable ...gopacket.SerializableLayer) []byte {
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true}
+	err := gopacket.SerializeLayers(buffer, options, serializable...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
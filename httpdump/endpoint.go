@@ -1,6 +1,9 @@
 package httpdump
 
-import "strconv"
+import (
+	"net"
+	"strconv"
+)
 
 // Endpoint is one endpoint of a tcp connection
 type Endpoint struct {
@@ -13,5 +16,5 @@ func (p Endpoint) equals(p2 Endpoint) bool {
 }
 
 func (p Endpoint) String() string {
-	return p.ip + ":" + strconv.Itoa(int(p.port))
+	return net.JoinHostPort(p.ip, strconv.Itoa(int(p.port)))
 }
@@ -0,0 +1,342 @@
+package httpdump
+
+import (
+	"bufio"
+	"github.com/alonana/httshark/core"
+	"github.com/alonana/httshark/core/aggregated"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const http2Proto = "HTTP/2.0"
+
+// the capture is passive, so the frames size and the HPACK table size are not limited by the settings
+const http2MaxFrameSize = 1<<24 - 1
+const http2MaxDynamicTableSize = 1 << 20
+
+// http2Stream collects the frames of one HTTP/2 stream
+type http2Stream struct {
+	id            uint32
+	request       *http.Request
+	requestBody   *bufferedBody
+	requestEnded  bool
+	response      *http.Response
+	responseBody  *bufferedBody
+	responseEnded bool
+	times         transactionTimes
+	headers       wireHeaders
+}
+
+// http2Connection demultiplexes the HTTP/2 frames of both directions into streams
+type http2Connection struct {
+	handler *HTTPTrafficHandler
+	mutex   sync.Mutex
+	streams map[uint32]*http2Stream
+}
+
+// if the client starts the connection using the HTTP/2 connection preface.
+// The PRI method is reserved for the preface, so an HTTP/1 request is never blocked waiting for the full preface.
+func isHTTP2Preface(reader *bufio.Reader) bool {
+	method, err := reader.Peek(3)
+	if err != nil || string(method) != "PRI" {
+		return false
+	}
+	preface, err := reader.Peek(len(http2.ClientPreface))
+	return err == nil && string(preface) == http2.ClientPreface
+}
+
+// if the response switches the connection to HTTP/2 following an h2c upgrade request
+func isH2CUpgrade(req *http.Request, resp *http.Response) bool {
+	return resp.StatusCode == http.StatusSwitchingProtocols &&
+		strings.EqualFold(req.Header.Get("Upgrade"), "h2c") &&
+		strings.EqualFold(resp.Header.Get("Upgrade"), "h2c")
+}
+
+// handleHTTP2 reads the HTTP/2 frames of both directions, and reports a transaction per stream.
+// In case of an h2c upgrade, the upgrade request is the request of stream 1,
+// and its response is sent by the server as an HTTP/2 response.
+func (h *HTTPTrafficHandler) handleHTTP2(requestReader *streamClock, responseReader *streamClock, upgrade *http.Request,
+	upgradeTimes transactionTimes, upgradeHeaders []string) {
+	core.V2("%v http2 traffic - starting", h.originalKey)
+	c := &http2Connection{
+		handler: h,
+		streams: make(map[uint32]*http2Stream),
+	}
+
+	if upgrade != nil {
+		stream := c.getStream(1)
+		stream.request = upgrade
+		stream.headers.request = upgradeHeaders
+		// keep the buffered upgrade body as is, so its original size is kept
+		buffered, ok := upgrade.Body.(*bufferedBody)
+		if !ok {
+			buffered = stream.requestBody
+			_, buffered.err = io.Copy(buffered, upgrade.Body)
+		}
+		if buffered.err != nil {
+			aggregated.Warn("read h2c upgrade request body failed: %v", core.LimitedError(buffered.err))
+			buffered.err = nil
+		}
+		stream.requestBody = buffered
+		stream.requestEnded = true
+		stream.times.requestStart = upgradeTimes.requestStart
+		stream.times.requestEnd = upgradeTimes.requestEnd
+	}
+
+	preface := make([]byte, len(http2.ClientPreface))
+	_, err := io.ReadFull(requestReader, preface)
+	if err != nil || string(preface) != http2.ClientPreface {
+		aggregated.Warn("HTTP/2 connection preface missing")
+		c.reportAll()
+		return
+	}
+
+	var serverFrames sync.WaitGroup
+	serverFrames.Add(1)
+	go func() {
+		defer serverFrames.Done()
+		c.readFrames(responseReader, false)
+	}()
+	c.readFrames(requestReader, true)
+	serverFrames.Wait()
+
+	c.reportAll()
+	core.V2("%v http2 traffic - terminating", h.originalKey)
+}
+
+func (c *http2Connection) readFrames(reader *streamClock, client bool) {
+	decoder := hpack.NewDecoder(4096, nil)
+	decoder.SetAllowedMaxDynamicTableSize(http2MaxDynamicTableSize)
+	framer := http2.NewFramer(ioutil.Discard, reader)
+	framer.SetMaxReadFrameSize(http2MaxFrameSize)
+	framer.ReadMetaHeaders = decoder
+
+	for {
+		start := reader.position()
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			if _, isStreamError := err.(http2.StreamError); isStreamError {
+				aggregated.Warn("parsing HTTP/2 stream failed: %v", core.LimitedError(err))
+				continue
+			}
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				aggregated.Warn("parsing HTTP/2 frame failed: %v", core.LimitedError(err))
+			}
+			return
+		}
+
+		c.mutex.Lock()
+		c.processFrame(frame, decoder, client, reader.timeAt(start), reader.lastByteTime())
+		c.mutex.Unlock()
+	}
+}
+
+// processFrame updates the stream of the frame, the start and end are the capture times of the frame first and last bytes
+func (c *http2Connection) processFrame(frame http2.Frame, decoder *hpack.Decoder, client bool, start time.Time, end time.Time) {
+	switch f := frame.(type) {
+	case *http2.MetaHeadersFrame:
+		stream := c.getStream(f.StreamID)
+		if client {
+			c.onRequestHeaders(stream, f, start)
+		} else {
+			c.onResponseHeaders(stream, f, start)
+		}
+		c.onFrameEnd(stream, client, end)
+		c.onEndStream(stream, client, f.StreamEnded())
+	case *http2.DataFrame:
+		stream := c.streams[f.StreamID]
+		if stream == nil {
+			return
+		}
+		if client {
+			stream.requestBody.Write(f.Data())
+		} else {
+			stream.responseBody.Write(f.Data())
+		}
+		c.onFrameEnd(stream, client, end)
+		c.onEndStream(stream, client, f.StreamEnded())
+	case *http2.PushPromiseFrame:
+		// the promised request headers must be decoded to keep the HPACK table in sync
+		fields, err := decoder.DecodeFull(f.HeaderBlockFragment())
+		if err != nil {
+			aggregated.Warn("decode HTTP/2 push promise failed: %v", core.LimitedError(err))
+			return
+		}
+		if !f.HeadersEnded() {
+			aggregated.Warn("HTTP/2 push promise continuation is not supported")
+			return
+		}
+		stream := c.getStream(f.PromiseID)
+		stream.request = c.createRequest(fields)
+		stream.headers.request = fieldLines(fields)
+		stream.requestEnded = true
+		stream.times.requestStart = start
+		stream.times.requestEnd = end
+	case *http2.RSTStreamFrame:
+		stream := c.streams[f.StreamID]
+		if stream != nil {
+			c.report(stream)
+		}
+	}
+}
+
+func (c *http2Connection) getStream(id uint32) *http2Stream {
+	stream := c.streams[id]
+	if stream == nil {
+		stream = &http2Stream{
+			id:           id,
+			requestBody:  newBufferedBody(core.Config.RequestBodyMaxSize),
+			responseBody: newBufferedBody(core.Config.ResponseBodyMaxSize),
+		}
+		c.streams[id] = stream
+	}
+	return stream
+}
+
+func (c *http2Connection) onRequestHeaders(stream *http2Stream, frame *http2.MetaHeadersFrame, timestamp time.Time) {
+	if stream.request != nil {
+		addTrailers(stream.request.Header, frame.RegularFields())
+		stream.headers.request = append(stream.headers.request, fieldLines(frame.Fields)...)
+		return
+	}
+	stream.request = c.createRequest(frame.Fields)
+	stream.headers.request = fieldLines(frame.Fields)
+	stream.times.requestStart = timestamp
+}
+
+func (c *http2Connection) onResponseHeaders(stream *http2Stream, frame *http2.MetaHeadersFrame, timestamp time.Time) {
+	if stream.response != nil {
+		addTrailers(stream.response.Header, frame.RegularFields())
+		stream.headers.response = append(stream.headers.response, fieldLines(frame.Fields)...)
+		return
+	}
+	code, err := strconv.Atoi(frame.PseudoValue("status"))
+	if err != nil {
+		aggregated.Warn("invalid HTTP/2 response status: %v", core.LimitedError(err))
+		return
+	}
+	// informational responses are followed by the final response
+	if code >= 100 && code < 200 {
+		return
+	}
+	stream.response = &http.Response{
+		Status:     strconv.Itoa(code) + " " + http.StatusText(code),
+		StatusCode: code,
+		Proto:      http2Proto,
+		ProtoMajor: 2,
+		Header:     toHeader(frame.RegularFields()),
+	}
+	stream.headers.response = fieldLines(frame.Fields)
+	stream.times.responseStart = timestamp
+}
+
+// onFrameEnd updates the capture time of the last byte of the stream request or response
+func (c *http2Connection) onFrameEnd(stream *http2Stream, client bool, timestamp time.Time) {
+	if client {
+		if stream.request != nil && !stream.requestEnded {
+			stream.times.requestEnd = timestamp
+		}
+	} else if stream.response != nil {
+		stream.times.responseEnd = timestamp
+	}
+}
+
+func (c *http2Connection) createRequest(fields []hpack.HeaderField) *http.Request {
+	var regular []hpack.HeaderField
+	pseudo := make(map[string]string)
+	for _, field := range fields {
+		if field.IsPseudo() {
+			pseudo[field.Name[1:]] = field.Value
+		} else {
+			regular = append(regular, field)
+		}
+	}
+
+	requestUrl, err := url.ParseRequestURI(pseudo["path"])
+	if err != nil {
+		requestUrl = &url.URL{Path: pseudo["path"]}
+	}
+	return &http.Request{
+		Method:     pseudo["method"],
+		URL:        requestUrl,
+		Proto:      http2Proto,
+		ProtoMajor: 2,
+		Header:     toHeader(regular),
+		Host:       pseudo["authority"],
+	}
+}
+
+// the stream is reported once the response ends, even if the request is still sent
+func (c *http2Connection) onEndStream(stream *http2Stream, client bool, ended bool) {
+	if !ended {
+		return
+	}
+	if client {
+		stream.requestEnded = true
+		return
+	}
+	stream.responseEnded = true
+	c.report(stream)
+}
+
+func (c *http2Connection) report(stream *http2Stream) {
+	delete(c.streams, stream.id)
+	if stream.request == nil {
+		return
+	}
+
+	stream.request.Body = stream.requestBody
+	if stream.response != nil {
+		stream.response.Body = stream.responseBody
+	}
+	c.handler.report(stream.request, stream.response, stream.times, stream.headers)
+}
+
+// report the streams that were not completed when the connection ended
+func (c *http2Connection) reportAll() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var ids []int
+	for id := range c.streams {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		c.report(c.streams[uint32(id)])
+	}
+}
+
+func toHeader(fields []hpack.HeaderField) http.Header {
+	header := make(http.Header)
+	for _, field := range fields {
+		header.Add(field.Name, field.Value)
+	}
+	return header
+}
+
+// fieldLines returns a header line for each regular field, in the order of the fields
+func fieldLines(fields []hpack.HeaderField) []string {
+	lines := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if !field.IsPseudo() {
+			lines = append(lines, field.Name+": "+field.Value)
+		}
+	}
+	return lines
+}
+
+func addTrailers(header http.Header, fields []hpack.HeaderField) {
+	for _, field := range fields {
+		header.Add(field.Name, field.Value)
+	}
+}
@@ -0,0 +1,164 @@
+package httpdump
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/alonana/httshark/core"
+	"github.com/alonana/httshark/core/aggregated"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// http2Writer encodes the frames of one direction
+type http2Writer struct {
+	buffer  bytes.Buffer
+	framer  *http2.Framer
+	encoder *hpack.Encoder
+	headers bytes.Buffer
+}
+
+func newHttp2Writer() *http2Writer {
+	w := &http2Writer{}
+	w.framer = http2.NewFramer(&w.buffer, nil)
+	w.encoder = hpack.NewEncoder(&w.headers)
+	return w
+}
+
+func (w *http2Writer) writeHeaders(t *testing.T, streamID uint32, endStream bool, fields ...string) {
+	w.headers.Reset()
+	for i := 0; i < len(fields); i += 2 {
+		_ = w.encoder.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	err := w.framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      streamID,
+		BlockFragment: w.headers.Bytes(),
+		EndStream:     endStream,
+		EndHeaders:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (w *http2Writer) writeData(t *testing.T, streamID uint32, endStream bool, data string) {
+	err := w.framer.WriteData(streamID, endStream, []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+var aggregatedLogOnce sync.Once
+
+func collectTransactions(t *testing.T, run func()) []core.HttpTransaction {
+	aggregatedLogOnce.Do(func() {
+		core.Config.AggregatedLogInterval = time.Hour
+		aggregated.InitLog()
+	})
+
+	var mutex sync.Mutex
+	var transactions []core.HttpTransaction
+	previous := processor
+	processor = func(transaction core.HttpTransaction) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		transactions = append(transactions, transaction)
+	}
+	defer func() { processor = previous }()
+	run()
+	return transactions
+}
+
+func TestHttp2PriorKnowledge(t *testing.T) {
+	client := newHttp2Writer()
+	client.buffer.WriteString(http2.ClientPreface)
+	_ = client.framer.WriteSettings()
+	client.writeHeaders(t, 1, true, ":method", "GET", ":scheme", "http", ":authority", "example.com", ":path", "/first?a=1")
+	client.writeHeaders(t, 3, false, ":method", "POST", ":scheme", "http", ":authority", "example.com", ":path", "/second", "content-type", "application/json")
+	client.writeData(t, 3, true, `{"id":3}`)
+
+	server := newHttp2Writer()
+	_ = server.framer.WriteSettings()
+	// the responses are interleaved, the second stream completes first
+	server.writeHeaders(t, 3, false, ":status", "201", "content-type", "application/json")
+	server.writeHeaders(t, 1, false, ":status", "200")
+	server.writeData(t, 3, true, `{"created":true}`)
+	server.writeData(t, 1, true, "first")
+
+	transactions := collectTransactions(t, func() {
+		h := &HTTPTrafficHandler{originalKey: "test"}
+		h.handleHTTP2(newStreamClock(untimed(&client.buffer)), newStreamClock(untimed(&server.buffer)), nil, transactionTimes{}, nil)
+	})
+
+	if len(transactions) != 2 {
+		t.Fatalf("expected 2 transactions, but got %+v", transactions)
+	}
+	for _, transaction := range transactions {
+		if transaction.Request.Version != http2Proto || transaction.Response == nil || transaction.Response.Version != http2Proto {
+			t.Fatalf("wrong version %+v", transaction)
+		}
+		switch transaction.Request.Path {
+		case "http://example.com/first":
+			if transaction.Request.Query != "a=1" || transaction.Response.Code != 200 || transaction.Response.Data != "first" {
+				t.Fatalf("wrong first transaction %+v", transaction)
+			}
+		case "http://example.com/second":
+			if transaction.Request.Method != "POST" || transaction.Request.Data != `{"id":3}` ||
+				transaction.Response.Code != 201 || transaction.Response.Data != `{"created":true}` {
+				t.Fatalf("wrong second transaction %+v", transaction)
+			}
+			if len(transaction.Request.Headers) != 1 || transaction.Request.Headers[0] != "content-type: application/json" {
+				t.Fatalf("wrong second request headers %v", transaction.Request.Headers)
+			}
+		default:
+			t.Fatalf("unexpected transaction %+v", transaction)
+		}
+	}
+}
+
+func TestHttp2Upgrade(t *testing.T) {
+	request, err := http.ReadRequest(bufio.NewReader(strings.NewReader(
+		"GET /upgraded HTTP/1.1\r\nHost: example.com\r\nUpgrade: h2c\r\nConnection: Upgrade, HTTP2-Settings\r\n\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := newHttp2Writer()
+	client.buffer.WriteString(http2.ClientPreface)
+	_ = client.framer.WriteSettings()
+
+	server := newHttp2Writer()
+	_ = server.framer.WriteSettings()
+	server.writeHeaders(t, 1, false, ":status", "200")
+	server.writeData(t, 1, true, "upgraded")
+
+	transactions := collectTransactions(t, func() {
+		h := &HTTPTrafficHandler{originalKey: "test"}
+		h.handleHTTP2(newStreamClock(untimed(&client.buffer)), newStreamClock(untimed(&server.buffer)), request, transactionTimes{}, nil)
+	})
+
+	if len(transactions) != 1 {
+		t.Fatalf("expected 1 transaction, but got %+v", transactions)
+	}
+	transaction := transactions[0]
+	if transaction.Request.Path != "http://example.com/upgraded" || transaction.Response == nil ||
+		transaction.Response.Code != 200 || transaction.Response.Data != "upgraded" {
+		t.Fatalf("wrong upgraded transaction %+v", transaction)
+	}
+}
+
+func TestHttp2Preface(t *testing.T) {
+	if !isHTTP2Preface(bufio.NewReader(strings.NewReader(http2.ClientPreface))) {
+		t.Fatalf("preface not detected")
+	}
+	if isHTTP2Preface(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))) {
+		t.Fatalf("HTTP/1 request detected as preface")
+	}
+	if !isHTTPRequestData([]byte(http2.ClientPreface)) {
+		t.Fatalf("preface is not accepted as the first request data")
+	}
+}
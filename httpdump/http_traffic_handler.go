@@ -1,7 +1,6 @@
 package httpdump
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
 	"github.com/alonana/httshark/core"
@@ -10,45 +9,153 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// handlers tracks the running traffic handlers go routines
+var handlers sync.WaitGroup
+
 func newHttpTrafficHandler(originalKey string, src Endpoint, dst Endpoint, connection *TCPConnection) {
 	ck := ConnectionKey{src, dst}
 	trafficHandler := &HTTPTrafficHandler{
 		originalKey: originalKey,
 		key:         ck,
 		buffer:      new(bytes.Buffer),
-		startTime:   connection.lastTimestamp,
+		tunnel:      connection.tunnel,
+		tls:         connection.tls,
+		metrics:     connection.metrics,
 	}
-	go trafficHandler.handle(connection)
+	handlers.Add(1)
+	go func() {
+		defer handlers.Done()
+		trafficHandler.handle(connection)
+	}()
+}
+
+// wait for all traffic handlers to complete reporting their transactions
+func waitForHandlers() {
+	handlers.Wait()
 }
 
 type HTTPTrafficHandler struct {
-	startTime   time.Time
-	endTime     time.Time
 	key         ConnectionKey
 	buffer      *bytes.Buffer
 	originalKey string
+	tunnel      *core.HttpTunnel
+	tls         bool
+	metrics     *tcpMetrics
+}
+
+// wireHeaders are the header lines of the request and the response, as they were sent.
+// They are nil when the message was not parsed from the wire, and the parsed headers are used instead.
+type wireHeaders struct {
+	request  []string
+	response []string
+}
+
+// transactionTimes are the capture times of the first and the last bytes of the request and the response
+type transactionTimes struct {
+	requestStart  time.Time
+	requestEnd    time.Time
+	responseStart time.Time
+	responseEnd   time.Time
+}
+
+// readRequestBody reads the request body in advance, to get the capture time of the last request byte
+func (t *transactionTimes) readRequestBody(req *http.Request, reader *streamClock) {
+	req.Body = bufferBody(req.Body, core.Config.RequestBodyMaxSize)
+	t.requestEnd = reader.lastByteTime()
+}
+
+// readResponseBody reads the response body in advance, to get the capture time of the last response byte
+func (t *transactionTimes) readResponseBody(resp *http.Response, reader *streamClock) {
+	resp.Body = bufferBody(resp.Body, core.Config.ResponseBodyMaxSize)
+	t.responseEnd = reader.lastByteTime()
+}
+
+// bufferedBody is a body that was read in advance, and returns the read error once its data is consumed.
+// Only the first max size bytes of the body are kept, while the size counts the whole body.
+type bufferedBody struct {
+	data      bytes.Buffer
+	maxSize   int
+	size      int
+	truncated bool
+	err       error
+}
+
+func newBufferedBody(maxSize int) *bufferedBody {
+	return &bufferedBody{maxSize: maxSize}
+}
+
+func bufferBody(body io.ReadCloser, maxSize int) io.ReadCloser {
+	buffered := newBufferedBody(maxSize)
+	_, buffered.err = io.Copy(buffered, body)
+	return buffered
+}
+
+// Write keeps the bytes that fit in the max size, and discards the rest
+func (b *bufferedBody) Write(p []byte) (int, error) {
+	b.size += len(p)
+	kept := p
+	if b.maxSize > 0 && b.data.Len()+len(p) > b.maxSize {
+		kept = p[:b.maxSize-b.data.Len()]
+		b.truncated = true
+	}
+	b.data.Write(kept)
+	return len(p), nil
+}
+
+func (b *bufferedBody) Read(p []byte) (int, error) {
+	n, err := b.data.Read(p)
+	if err == io.EOF && b.err != nil {
+		return n, b.err
+	}
+	return n, err
+}
+
+func (b *bufferedBody) Close() error {
+	return nil
+}
+
+// setBodySize records the size of the whole body in the entry, if the body was truncated while it was buffered
+func setBodySize(entry *core.HttpEntry, body io.ReadCloser) {
+	buffered, ok := body.(*bufferedBody)
+	if !ok || !buffered.truncated {
+		return
+	}
+	entry.OriginalSize = buffered.size
+	entry.Truncated = true
 }
 
 // read http request/response stream, and do output
 func (h *HTTPTrafficHandler) handle(connection *TCPConnection) {
 	core.V2("%v http traffic - starting", h.originalKey)
-	defer func() { _ = connection.upStream.Close() }()
-	defer func() { _ = connection.downStream.Close() }()
+	upStream, downStream := connection.readers()
+	defer func() { _ = upStream.Close() }()
+	defer func() { _ = downStream.Close() }()
 
-	requestReader := bufio.NewReader(connection.upStream)
+	requestReader := newStreamClock(upStream)
 	defer discardAll(requestReader)
-	responseReader := bufio.NewReader(connection.downStream)
+	responseReader := newStreamClock(downStream)
 	defer discardAll(responseReader)
 
 	for {
 		core.V2("%v http traffic - lopping", h.originalKey)
 
 		h.buffer = new(bytes.Buffer)
-		req, err := http.ReadRequest(requestReader)
-		h.startTime = connection.lastTimestamp
+		if isHTTP2Preface(requestReader.Reader) {
+			h.handleHTTP2(requestReader, responseReader, nil, transactionTimes{}, nil)
+			break
+		}
+
+		requestStart := requestReader.position()
+		requestReader.startRecording()
+		req, err := http.ReadRequest(requestReader.Reader)
+		headers := wireHeaders{request: headerLines(requestReader.stopRecording())}
 
 		if err != nil {
 			if err == io.EOF {
@@ -59,45 +166,69 @@ func (h *HTTPTrafficHandler) handle(connection *TCPConnection) {
 			}
 			break
 		}
+		times := transactionTimes{requestStart: requestReader.timeAt(requestStart)}
 
 		// if is websocket request,  by header: Upgrade: websocket
 		expectContinue := req.Header.Get("Expect") == "100-continue"
 
 		core.V2("%v http traffic - reading response starting", h.originalKey)
-		resp, err := http.ReadResponse(responseReader, nil)
+		responseStart := responseReader.position()
+		responseReader.startRecording()
+		resp, err := http.ReadResponse(responseReader.Reader, nil)
+		headers.response = headerLines(responseReader.stopRecording())
 		core.V2("%v http traffic - reading response done", h.originalKey)
 
 		if err != nil {
 			if err != io.EOF && err != io.ErrUnexpectedEOF {
 				aggregated.Warn("parsing HTTP response failed: %v", core.LimitedError(err))
 			}
-			h.report(req, nil)
+			times.readRequestBody(req, requestReader)
+			h.report(req, nil, times, headers)
 			discardAll(req.Body)
 			core.V2("%v http traffic - read response error", h.originalKey)
 			break
 		}
 
-		h.endTime = connection.lastTimestamp
+		times.responseStart = responseReader.timeAt(responseStart)
+		times.readRequestBody(req, requestReader)
+		times.readResponseBody(resp, responseReader)
+
+		if isWebSocketUpgrade(resp) {
+			core.V2("%v http traffic - upgrade to websocket", h.originalKey)
+			h.handleWebSocket(requestReader, responseReader, req, resp, times, headers)
+			break
+		}
+
+		if isH2CUpgrade(req, resp) {
+			core.V2("%v http traffic - upgrade to h2c", h.originalKey)
+			h.handleHTTP2(requestReader, responseReader, req, times, headers.request)
+			break
+		}
 
 		core.V2("%v http traffic - reporting", h.originalKey)
-		h.report(req, resp)
+		h.report(req, resp, times, headers)
 		discardAll(req.Body)
 
 		if expectContinue {
 			core.V2("%v http traffic - expect continue", h.originalKey)
 			if resp.StatusCode == 100 {
 				// read next response, the real response
-				resp, err := http.ReadResponse(responseReader, nil)
+				responseStart := responseReader.position()
+				responseReader.startRecording()
+				resp, err := http.ReadResponse(responseReader.Reader, nil)
+				headers.response = headerLines(responseReader.stopRecording())
 				if err != nil {
 					if err != io.EOF && err != io.ErrUnexpectedEOF {
 						aggregated.Warn("parsing HTTP continue response failed: %v", core.LimitedError(err))
 					}
-					h.report(req, nil)
+					h.report(req, nil, times, headers)
 					discardAll(req.Body)
 					core.V2("%v http traffic - expect continue read response error", h.originalKey)
 					break
 				}
-				h.report(req, resp)
+				times.responseStart = responseReader.timeAt(responseStart)
+				times.readResponseBody(resp, responseReader)
+				h.report(req, resp, times, headers)
 			}
 		}
 	}
@@ -105,28 +236,51 @@ func (h *HTTPTrafficHandler) handle(connection *TCPConnection) {
 	core.V2("%v http traffic - terminating", h.originalKey)
 }
 
-func (h *HTTPTrafficHandler) report(req *http.Request, res *http.Response) {
+func (h *HTTPTrafficHandler) report(req *http.Request, res *http.Response, times transactionTimes, headers wireHeaders) {
+	transaction := h.createTransaction(req, res, times, headers)
+	if transaction != nil {
+		processor(*transaction)
+	}
+}
+
+// createTransaction reads the request and response bodies, and returns nil if the request body cannot be read
+func (h *HTTPTrafficHandler) createTransaction(req *http.Request, res *http.Response, times transactionTimes, headers wireHeaders) *core.HttpTransaction {
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		aggregated.Warn("read request body failed: %v", core.LimitedError(err))
-		return
+		return nil
 	}
 
-	fullUrl := "http://" + req.Host + req.URL.Path
-	transaction := core.HttpTransaction{
+	scheme := "http://"
+	if h.tls {
+		scheme = "https://"
+	}
+	fullUrl := scheme + req.Host + req.URL.Path
+	transaction := &core.HttpTransaction{
+		Tunnel:     h.tunnel,
+		TcpMetrics: h.metrics.take(),
 		Request: core.HttpRequest{
+			HttpIpAndPort: core.HttpIpAndPort{
+				SrcIP:        h.key.src.ip,
+				SrcPort:      int(h.key.src.port),
+				DstIP:        h.key.dst.ip,
+				DstPort:      int(h.key.dst.port),
+				ConnectionID: tunnelKey(h.tunnel) + h.key.String(),
+			},
 			HttpEntry: core.HttpEntry{
-				Time:    &h.startTime,
+				Time:    &times.requestStart,
+				EndTime: &times.requestEnd,
 				Stream:  0,
 				Data:    string(body),
 				Version: req.Proto,
-				Headers: h.convertHeaders(req.Header),
+				Headers: h.getHeaders(headers.request, req.Header),
 			},
 			Method: req.Method,
 			Path:   fullUrl,
 			Query:  req.URL.RawQuery,
 		},
 	}
+	setBodySize(&transaction.Request.HttpEntry, req.Body)
 
 	if res != nil {
 		body, err := ioutil.ReadAll(res.Body)
@@ -136,25 +290,66 @@ func (h *HTTPTrafficHandler) report(req *http.Request, res *http.Response) {
 		}
 		transaction.Response = &core.HttpResponse{
 			HttpEntry: core.HttpEntry{
-				Time:    &h.endTime,
+				Time:    &times.responseStart,
+				EndTime: &times.responseEnd,
 				Stream:  0,
 				Data:    string(body),
 				Version: res.Proto,
-				Headers: h.convertHeaders(res.Header),
+				Headers: h.getHeaders(headers.response, res.Header),
 			},
 			Code: res.StatusCode,
+			// the status holds the code followed by the reason phrase
+			StatusText: strings.TrimSpace(strings.TrimPrefix(res.Status, strconv.Itoa(res.StatusCode))),
 		}
+		setBodySize(&transaction.Response.HttpEntry, res.Body)
 	}
+	return transaction
+}
 
-	processor(transaction)
+// getHeaders returns the wire header lines, or the parsed headers if the wire lines are unknown
+func (h *HTTPTrafficHandler) getHeaders(lines []string, httpHeaders http.Header) []string {
+	if lines != nil {
+		return lines
+	}
+	return h.convertHeaders(httpHeaders)
 }
 
+// convertHeaders returns a line for each value of the headers, sorted by the header name
 func (h *HTTPTrafficHandler) convertHeaders(httpHeaders http.Header) []string {
-	headers := make([]string, len(httpHeaders))
-	i := 0
-	for name, values := range httpHeaders {
-		headers[i] = fmt.Sprintf("%v: %v", name, values[0])
-		i++
+	var names []string
+	for name := range httpHeaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	headers := make([]string, 0, len(names))
+	for _, name := range names {
+		for _, value := range httpHeaders[name] {
+			headers = append(headers, fmt.Sprintf("%v: %v", name, value))
+		}
+	}
+	return headers
+}
+
+// headerLines returns the header lines of a request or a response head, in their wire order and casing.
+// The first line is the request or status line, and an obsolete folded line is joined to its header line.
+func headerLines(head []byte) []string {
+	lines := strings.Split(string(head), "\n")
+	if len(lines) < 2 {
+		return nil
+	}
+
+	headers := make([]string, 0, len(lines))
+	for _, line := range lines[1:] {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		headers = append(headers, line)
 	}
 	return headers
 }
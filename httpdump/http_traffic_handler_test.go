@@ -0,0 +1,91 @@
+package httpdump
+
+import (
+	"github.com/alonana/httshark/core"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBodyLimits(t *testing.T) {
+	initStreamConfig()
+	core.Config.RequestBodyMaxSize = 4
+	core.Config.ResponseBodyMaxSize = 8
+	defer func() {
+		core.Config.RequestBodyMaxSize = 0
+		core.Config.ResponseBodyMaxSize = 0
+	}()
+
+	client := Endpoint{ip: "10.0.0.1", port: 50000}
+	server := Endpoint{ip: "10.0.0.2", port: 80}
+	requests := "POST /large HTTP/1.1\r\nHost: example.com\r\nContent-Length: 10\r\n\r\n0123456789" +
+		"POST /small HTTP/1.1\r\nHost: example.com\r\nContent-Length: 2\r\n\r\nab"
+	responses := "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 12\r\n\r\nhello world!"
+
+	now := time.Now()
+	connection := newTCPConnection("test", nil)
+	connection.onReceive(client, tcpPacket(1, 0, requests), now)
+	connection.onReceive(server, tcpPacket(1, 1+uint32(len(requests)), responses), now)
+	connection.forceClose()
+
+	transactions := collectTransactions(t, func() {
+		h := &HTTPTrafficHandler{originalKey: "test", key: ConnectionKey{client, server}}
+		h.handle(connection)
+	})
+
+	if len(transactions) != 2 {
+		t.Fatalf("expected 2 transactions, but got %+v", transactions)
+	}
+	large := transactions[0]
+	if !strings.HasSuffix(large.Request.Path, "/large") || large.Request.Data != "0123" ||
+		!large.Request.Truncated || large.Request.BodySize() != 10 {
+		t.Fatalf("wrong truncated request %+v", large.Request)
+	}
+	if large.Response.Data != "ok" || large.Response.Truncated || large.Response.BodySize() != 2 {
+		t.Fatalf("wrong response %+v", large.Response)
+	}
+
+	small := transactions[1]
+	if !strings.HasSuffix(small.Request.Path, "/small") || small.Request.Data != "ab" || small.Request.Truncated {
+		t.Fatalf("wrong request %+v", small.Request)
+	}
+	if small.Response.Data != "hello wo" || !small.Response.Truncated || small.Response.BodySize() != 12 {
+		t.Fatalf("wrong truncated response %+v", small.Response)
+	}
+}
+
+func TestWireHeaders(t *testing.T) {
+	initStreamConfig()
+
+	client := Endpoint{ip: "10.0.0.1", port: 50000}
+	server := Endpoint{ip: "10.0.0.2", port: 80}
+	request := "GET /items HTTP/1.1\r\nHost: example.com\r\nx-trace: a\r\nAccept: */*\r\nX-Trace: b\r\n\r\n"
+	response := "HTTP/1.1 200 OK\r\nSet-Cookie: a=1\r\nVia: 1.1 first\r\nSet-Cookie: b=2\r\n" +
+		"X-Folded: start\r\n  continued\r\nContent-Length: 0\r\n\r\n"
+
+	connection := newTCPConnection("test", nil)
+	connection.onReceive(client, tcpPacket(1, 0, request), time.Now())
+	connection.onReceive(server, tcpPacket(1, 1+uint32(len(request)), response), time.Now())
+	connection.forceClose()
+
+	transactions := collectTransactions(t, func() {
+		h := &HTTPTrafficHandler{originalKey: "test", key: ConnectionKey{client, server}}
+		h.handle(connection)
+	})
+
+	if len(transactions) != 1 || transactions[0].Response == nil {
+		t.Fatalf("expected 1 transaction, but got %+v", transactions)
+	}
+	if transactions[0].Response.StatusText != "OK" {
+		t.Fatalf("wrong status text %v", transactions[0].Response.StatusText)
+	}
+	requestHeaders := strings.Join(transactions[0].Request.Headers, "|")
+	if requestHeaders != "Host: example.com|x-trace: a|Accept: */*|X-Trace: b" {
+		t.Fatalf("wrong request headers %v", requestHeaders)
+	}
+	responseHeaders := strings.Join(transactions[0].Response.Headers, "|")
+	if responseHeaders != "Set-Cookie: a=1|Via: 1.1 first|Set-Cookie: b=2|X-Folded: start continued|Content-Length: 0" {
+		t.Fatalf("wrong response headers %v", responseHeaders)
+	}
+}
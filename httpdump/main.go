@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"github.com/alonana/httshark/core"
 	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"github.com/sirupsen/logrus"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,32 +21,65 @@ func listenOneSource(handle *pcap.Handle) chan gopacket.Packet {
 
 // set packet capture filter, by ip and port
 func setDeviceFilter(handle *pcap.Handle) error {
-	var filter string
-	hosts := core.ProduceHosts(core.Config.Hosts).GetHosts()
-	if len(hosts) == 1 {
-		filter = getHostFilter(hosts[0])
-	} else {
-		var filters []string
-		for i := 0; i < len(hosts); i++ {
-			filters = append(filters, getHostFilter(hosts[i]))
-		}
+	filter := getCaptureFilter()
+	core.V2("filter is %v", filter)
+	return handle.SetBPFFilter(filter)
+}
 
-		filter = fmt.Sprintf("(%v)", strings.Join(filters, ") or ("))
+// getDevicesFilter returns the BPF filter of the configured hosts
+func getDevicesFilter() string {
+	hosts := core.CapturedHosts()
+	filter := joinFilters(hosts.GetIncluded())
+	if filter == "" {
+		filter = "tcp"
 	}
 
-	core.V2("filter is %v", filter)
-	return handle.SetBPFFilter(filter)
+	excluded := joinFilters(hosts.GetExcluded())
+	if excluded != "" {
+		filter = fmt.Sprintf("(%v) and not (%v)", filter, excluded)
+	}
+	return filter
+}
+
+func joinFilters(hosts []core.Host) string {
+	if len(hosts) == 1 {
+		return getHostFilter(hosts[0])
+	}
+
+	var filters []string
+	for i := 0; i < len(hosts); i++ {
+		filters = append(filters, getHostFilter(hosts[i]))
+	}
+	if len(filters) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("(%v)", strings.Join(filters, ") or ("))
 }
 
 func getHostFilter(host core.Host) string {
+	ports := "tcp"
+	if host.IsPortRange() {
+		ports = fmt.Sprintf("tcp portrange %v-%v", host.Port, host.PortEnd)
+	} else if host.Port != 0 {
+		ports = fmt.Sprintf("tcp port %v", host.Port)
+	}
+
 	if len(host.Ip) == 0 {
-		return fmt.Sprintf("tcp port %v", host.Port)
+		return ports
 	}
 
-	return fmt.Sprintf("tcp port %v and host %v", host.Port, host.Ip)
+	family := ""
+	if host.IsIPv6() {
+		family = "ip6 "
+	}
+	kind := "host"
+	if host.IsNetwork() {
+		kind = "net"
+	}
+	return fmt.Sprintf("%v and %v%v %v", ports, family, kind, host.Ip)
 }
 
-func openSingleDevice(device string) (localPackets chan gopacket.Packet, err error) {
+func openSingleDevice(device string) (handle *pcap.Handle, err error) {
 	defer func() {
 		if msg := recover(); msg != nil {
 			//core.Error("open device recover")
@@ -56,61 +91,257 @@ func openSingleDevice(device string) (localPackets chan gopacket.Packet, err err
 			default:
 				err = errors.New("unknown panic")
 			}
-			localPackets = nil
+			handle = nil
 		}
 	}()
 
 	core.V1("open device %v", device)
-	handle, err := pcap.OpenLive(device, 65536, true, pcap.BlockForever)
+	handle, err = pcap.OpenLive(device, 65536, true, pcap.BlockForever)
+	if err != nil {
+		return
+	}
+
+	err = setDeviceFilter(handle)
+	if err != nil {
+		handle.Close()
+		handle = nil
+		err = fmt.Errorf("set capture filter failed: %v", err)
+	}
+	return
+}
+
+func openPcapFile(path string) (handle *pcap.Handle, err error) {
+	core.V1("open pcap file %v", path)
+	handle, err = pcap.OpenOffline(path)
 	if err != nil {
 		return
 	}
 
-	if err := setDeviceFilter(handle); err != nil {
-		//core.Fatal("set capture filter failed: %v", err)
+	err = setDeviceFilter(handle)
+	if err != nil {
+		handle.Close()
+		handle = nil
+		err = fmt.Errorf("set capture filter failed: %v", err)
 	}
-	localPackets = listenOneSource(handle)
 	return
 }
 
-type TransactionProcessor func(core.HttpTransaction)
+var processor core.TransactionProcessor
 
-var processor TransactionProcessor
+// the timestamp of the last packet read from the pcap file, in unix nanoseconds
+var pcapTime int64
 
-func RunHttpDump(p TransactionProcessor) {
+// captureTime returns the current time of the capture, which is the wall clock when capturing from an interface,
+// and the timestamp of the last read packet when reading a pcap file
+func captureTime() time.Time {
+	if core.Config.PcapFile == "" {
+		return time.Now()
+	}
+	return time.Unix(0, atomic.LoadInt64(&pcapTime))
+}
+
+func init() {
+	core.RegisterCaptureEngine("httpdump", func(logger *logrus.Logger) core.CaptureEngine {
+		return &Engine{Logger: logger}
+	})
+}
+
+// Engine captures packets using libpcap, and assembles the HTTP transactions from the TCP connections.
+type Engine struct {
+	Logger      *logrus.Logger
+	sources     []*captureSource
+	assembler   *TCPAssembler
+	stopChannel chan bool
+	done        chan bool
+	flushed     int // the connections flushed when the capture stopped
+}
+
+// captureSource is a single captured interface, or a pcap file
+type captureSource struct {
+	name     string
+	handle   *pcap.Handle
+	captured uint64
+}
+
+// size of the channel that merges the packets from all the sources
+const mergedPacketsBuffer = 1024
+
+func (e *Engine) Start(p core.TransactionProcessor) error {
 	processor = p
-	var err error
-	packets, err := openSingleDevice(core.Config.Device)
-	if err != nil {
-		//core.Fatal("listen on device %v failed, error: %w", core.Config.Device, err)
+	if core.Config.PcapFile != "" {
+		handle, err := openPcapFile(core.Config.PcapFile)
+		if err != nil {
+			return fmt.Errorf("read pcap file %v failed: %v", core.Config.PcapFile, err)
+		}
+		e.sources = append(e.sources, &captureSource{name: core.Config.PcapFile, handle: handle})
+	} else {
+		for _, device := range core.Devices() {
+			handle, err := openSingleDevice(device)
+			if err != nil {
+				e.close()
+				return fmt.Errorf("listen on device %v failed: %v", device, err)
+			}
+			e.sources = append(e.sources, &captureSource{name: device, handle: handle})
+		}
+	}
+
+	e.assembler = newTCPAssembler()
+	e.stopChannel = make(chan bool, 1)
+	e.done = make(chan bool)
+	go e.run(e.mergeSources())
+	return nil
+}
+
+// merge the packets from all the sources into a single channel, that is closed once all the sources are exhausted.
+// Once the packets loop is done, the packets are discarded until the sources end, which is when their handles are closed.
+func (e *Engine) mergeSources() chan gopacket.Packet {
+	packets := make(chan gopacket.Packet, mergedPacketsBuffer)
+	var sources sync.WaitGroup
+	for _, source := range e.sources {
+		sources.Add(1)
+		go func(source *captureSource) {
+			defer sources.Done()
+			e.forward(listenOneSource(source.handle), source, packets)
+		}(source)
+	}
+
+	go func() {
+		sources.Wait()
+		close(packets)
+	}()
+	return packets
+}
+
+// forward the packets of a single source to the merged channel, until the source ends
+func (e *Engine) forward(sourcePackets chan gopacket.Packet, source *captureSource, packets chan gopacket.Packet) {
+	for packet := range sourcePackets {
+		atomic.AddUint64(&source.captured, 1)
+		select {
+		case packets <- packet:
+		case <-e.done:
+		}
+	}
+}
+
+// Stop the capture, and wait for the in progress connections to report their transactions
+func (e *Engine) Stop() core.FlushStats {
+	select {
+	case <-e.done:
+	default:
+		e.stopChannel <- true
+		<-e.done
+	}
+
+	for _, stats := range e.Stats() {
+		e.Logger.Info(fmt.Sprintf("interface %v captured %v packets (received: %v, dropped: %v, interface dropped: %v)",
+			stats.Interface, stats.Captured, stats.Received, stats.Dropped, stats.IfDropped))
+	}
+	e.close()
+	return core.FlushStats{Connections: e.flushed}
+}
+
+// close the handles, which ends the sources, and so their forwarders and the merged channel
+func (e *Engine) close() {
+	for _, source := range e.sources {
+		source.handle.Close()
 	}
+}
+
+func (e *Engine) Done() <-chan bool {
+	return e.done
+}
+
+func (e *Engine) Stats() []core.CaptureStats {
+	var allStats []core.CaptureStats
+	for _, source := range e.sources {
+		stats := core.CaptureStats{
+			Interface: source.name,
+			Captured:  atomic.LoadUint64(&source.captured),
+		}
+		if core.Config.PcapFile == "" {
+			pcapStats, err := source.handle.Stats()
+			if err != nil {
+				e.Logger.Warn(fmt.Sprintf("read capture stats of %v failed: %v", source.name, err))
+			} else {
+				stats.Received = uint64(pcapStats.PacketsReceived)
+				stats.Dropped = uint64(pcapStats.PacketsDropped)
+				stats.IfDropped = uint64(pcapStats.PacketsIfDropped)
+			}
+		}
+		allStats = append(allStats, stats)
+	}
+	return allStats
+}
 
-	var assembler = newTCPAssembler()
-	var ticker = time.Tick(time.Second * 10)
+// run the packets loop until the capture is stopped.
+// When reading a pcap file, the loop ends once the file was fully processed.
+func (e *Engine) run(packets chan gopacket.Packet) {
+	defer close(e.done)
+	offline := core.Config.PcapFile != ""
+	var flushInterval = time.Second * 10
+
+	// when reading a file, the connections are flushed by the packets time rather than the wall time
+	var ticker <-chan time.Time
+	var lastFlush time.Time
+	if !offline {
+		ticker = time.Tick(flushInterval)
+	}
 
 	for {
 		core.V2("waiting on http dump channels")
 		select {
-		case packet := <-packets:
+		case packet, ok := <-packets:
 			core.V2("got packet")
-			// A nil packet indicates the end of a pcap file.
-			if packet == nil {
-				//core.Warn("END of PCAP sampling??")
-				continue
+			// the channel is closed once all the sources ended, which is the end of a pcap file,
+			// or the interfaces that went away
+			if !ok || packet == nil {
+				if offline {
+					core.V1("end of pcap file %v", core.Config.PcapFile)
+				} else {
+					e.Logger.Warn("all the capture interfaces were closed, stopping the capture")
+				}
+				e.flush()
+				return
 			}
 
-			// only assembly tcp/ip packets
-			if packet.NetworkLayer() == nil || packet.TransportLayer() == nil ||
-				packet.TransportLayer().LayerType() != layers.LayerTypeTCP {
-				continue
+			timestamp := packet.Metadata().Timestamp
+			if offline {
+				atomic.StoreInt64(&pcapTime, timestamp.UnixNano())
+				if lastFlush.IsZero() {
+					lastFlush = timestamp
+				} else if timestamp.Sub(lastFlush) > flushInterval {
+					core.V2("flush older")
+					e.assembler.flushOlderThan(timestamp.Add(-core.Config.ResponseTimeout))
+					lastFlush = timestamp
+				}
 			}
-			var tcp = packet.TransportLayer().(*layers.TCP)
 
-			assembler.assemble(packet.NetworkLayer().NetworkFlow(), tcp, packet.Metadata().Timestamp)
+			assemblePacket(e.assembler, packet)
 
 		case <-ticker:
 			core.V2("flush older")
-			assembler.flushOlderThan(time.Now().Add(-core.Config.ResponseTimeout))
+			e.assembler.flushOlderThan(time.Now().Add(-core.Config.ResponseTimeout))
+
+		case <-e.stopChannel:
+			core.V1("http dump stopping")
+			e.flush()
+			return
 		}
 	}
 }
+
+// assemblePacket sends the innermost tcp/ip layers of the packet to the assembler, ignoring packets that are not tcp/ip
+func assemblePacket(assembler *TCPAssembler, packet gopacket.Packet) {
+	network, tcp, tunnel := decapsulate(packet)
+	if tcp == nil {
+		return
+	}
+
+	assembler.assemble(network.NetworkFlow(), tcp, tunnel, packet.Metadata().Timestamp)
+}
+
+// flush all connections, and wait for their transactions
+func (e *Engine) flush() {
+	e.flushed = e.assembler.flushAll()
+	waitForHandlers()
+}
@@ -0,0 +1,56 @@
+package httpdump
+
+import (
+	"github.com/google/gopacket"
+	"github.com/sirupsen/logrus"
+	"testing"
+	"time"
+)
+
+func TestSourcesEnded(t *testing.T) {
+	initStreamConfig()
+	e := &Engine{
+		Logger:      logrus.New(),
+		assembler:   newTCPAssembler(),
+		stopChannel: make(chan bool, 1),
+		done:        make(chan bool),
+	}
+	packets := make(chan gopacket.Packet)
+	close(packets)
+	go e.run(packets)
+
+	select {
+	case <-e.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the capture should end once all the interfaces were closed")
+	}
+}
+
+func TestForwardAfterStop(t *testing.T) {
+	e := &Engine{done: make(chan bool)}
+	source := &captureSource{name: "test"}
+	sourcePackets := make(chan gopacket.Packet)
+	// the merged channel is full, and no longer read once the packets loop is done
+	packets := make(chan gopacket.Packet, 1)
+	packets <- nil
+
+	forwarded := make(chan bool)
+	go func() {
+		e.forward(sourcePackets, source, packets)
+		close(forwarded)
+	}()
+	sourcePackets <- nil
+	close(e.done)
+	sourcePackets <- nil
+	// the closed handle ends the source
+	close(sourcePackets)
+
+	select {
+	case <-forwarded:
+	case <-time.After(time.Second):
+		t.Fatal("the forwarder should end once the source ended")
+	}
+	if source.captured != 2 {
+		t.Fatalf("expected 2 captured packets, but got %v", source.captured)
+	}
+}
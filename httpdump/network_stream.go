@@ -11,8 +11,9 @@ import (
 // NetworkStream tread one-direction tcp data as stream. impl reader closer
 type NetworkStream struct {
 	window         *ReceiveWindow
-	c              chan *layers.TCP
+	c              chan *streamPacket
 	remain         []byte
+	times          streamTimes
 	ignore         bool
 	closed         bool
 	eofSimulated   bool
@@ -20,20 +21,20 @@ type NetworkStream struct {
 	opposite       *NetworkStream
 }
 
-func newNetworkStream(keyDescription string) *NetworkStream {
+func newNetworkStream(keyDescription string, metrics *tcpMetrics) *NetworkStream {
 	return &NetworkStream{
-		window:         newReceiveWindow(64, keyDescription),
-		c:              make(chan *layers.TCP, core.Config.NetworkStreamChannelSize),
+		window:         newReceiveWindow(64, keyDescription, metrics),
+		c:              make(chan *streamPacket, core.Config.NetworkStreamChannelSize),
 		keyDescription: keyDescription,
 	}
 }
 
-func (s *NetworkStream) appendPacket(tcp *layers.TCP) {
+func (s *NetworkStream) appendPacket(tcp *layers.TCP, timestamp time.Time) {
 	core.V2("stream append packet")
 	if s.ignore || s.eofSimulated {
 		return
 	}
-	s.window.insert(tcp)
+	s.window.insert(&streamPacket{TCP: tcp, timestamp: timestamp})
 }
 
 func (s *NetworkStream) confirmPacket(ack uint32) {
@@ -47,6 +48,17 @@ func (s *NetworkStream) confirmPacket(ack uint32) {
 	s.window.confirm(ack, s.c)
 }
 
+// send all the packets in the window to the reader, regardless of the ACK
+func (s *NetworkStream) confirmAll() {
+	if s.ignore || s.eofSimulated || s.window.size == 0 {
+		return
+	}
+	if !s.waitForChannelSpace() {
+		return
+	}
+	s.window.confirmAll(s.c)
+}
+
 func (s *NetworkStream) waitForChannelSpace() bool {
 	startWaitTime := time.Now()
 	for len(s.c) >= core.Config.NetworkStreamChannelSize {
@@ -69,7 +81,7 @@ func (s *NetworkStream) finish() {
 
 func (s *NetworkStream) Read(p []byte) (n int, err error) {
 	core.V2("read from %v starting", s.keyDescription)
-	lastActiveTime := time.Now()
+	lastActiveTime := captureTime()
 	for len(s.remain) == 0 {
 		timeout := time.NewTimer(core.Config.NetworkStreamChannelTimeout)
 		select {
@@ -81,7 +93,8 @@ func (s *NetworkStream) Read(p []byte) (n int, err error) {
 				return
 			}
 			s.remain = packet.Payload
-			lastActiveTime = time.Now()
+			s.times.add(len(packet.Payload), packet.timestamp)
+			lastActiveTime = captureTime()
 		case <-timeout.C:
 			core.V2("key %v opposite length is %v", s.keyDescription, len(s.opposite.c))
 			if len(s.opposite.c) == core.Config.NetworkStreamChannelSize {
@@ -90,7 +103,7 @@ func (s *NetworkStream) Read(p []byte) (n int, err error) {
 				s.eofSimulated = true
 				return
 			}
-			nonActive := time.Now().Sub(lastActiveTime)
+			nonActive := captureTime().Sub(lastActiveTime)
 			if nonActive > core.Config.ResponseTimeout {
 				core.V2("non active connection for %v", nonActive)
 				aggregated.Warn("simulating EOF on a non active connection")
@@ -113,6 +126,11 @@ func (s *NetworkStream) Read(p []byte) (n int, err error) {
 	return
 }
 
+// timeAt returns the capture time of the packet that carried the byte in the offset
+func (s *NetworkStream) timeAt(offset int64) time.Time {
+	return s.times.timeAt(offset)
+}
+
 // Close the stream
 func (s *NetworkStream) Close() error {
 	s.ignore = true
@@ -0,0 +1,45 @@
+package httpdump
+
+import (
+	"github.com/alonana/httshark/core"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPcapFileInactivity(t *testing.T) {
+	initStreamConfig()
+	core.Config.NetworkStreamChannelTimeout = 5 * time.Millisecond
+	core.Config.ResponseTimeout = 50 * time.Millisecond
+	core.Config.PcapFile = "test.pcap"
+	defer func() { core.Config.PcapFile = "" }()
+
+	base := time.Unix(1000, 0)
+	atomic.StoreInt64(&pcapTime, base.UnixNano())
+
+	stream := newNetworkStream("test", nil)
+	stream.opposite = newNetworkStream("opposite", nil)
+	read := make(chan error, 1)
+	go func() {
+		_, err := stream.Read(make([]byte, 16))
+		read <- err
+	}()
+
+	// the wall clock passes the response timeout, while the pcap file time does not
+	select {
+	case err := <-read:
+		t.Fatalf("read returned %v before the pcap file time passed the response timeout", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	atomic.StoreInt64(&pcapTime, base.Add(time.Minute).UnixNano())
+	select {
+	case err := <-read:
+		if err != io.EOF || !stream.eofSimulated {
+			t.Fatalf("expected a simulated EOF, but got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read did not end once the pcap file time passed the response timeout")
+	}
+}
@@ -3,23 +3,32 @@ package httpdump
 import (
 	"github.com/alonana/httshark/core"
 	"github.com/google/gopacket/layers"
+	"time"
 )
 
+// streamPacket is a tcp packet with its capture time
+type streamPacket struct {
+	*layers.TCP
+	timestamp time.Time
+}
+
 // ReceiveWindow simulate tcp receive window
 type ReceiveWindow struct {
 	size           int
 	start          int
-	buffer         []*layers.TCP
+	buffer         []*streamPacket
 	lastAck        uint32
 	expectBegin    uint32
 	keyDescription string
+	metrics        *tcpMetrics
 }
 
-func newReceiveWindow(initialSize int, keyDescription string) *ReceiveWindow {
-	buffer := make([]*layers.TCP, initialSize)
+func newReceiveWindow(initialSize int, keyDescription string, metrics *tcpMetrics) *ReceiveWindow {
+	buffer := make([]*streamPacket, initialSize)
 	return &ReceiveWindow{
 		buffer:         buffer,
 		keyDescription: keyDescription,
+		metrics:        metrics,
 	}
 }
 
@@ -29,14 +38,15 @@ func (w *ReceiveWindow) destroy() {
 	w.buffer = nil
 }
 
-func (w *ReceiveWindow) insert(packet *layers.TCP) {
-	if w.expectBegin != 0 && compareTCPSeq(w.expectBegin, packet.Seq+uint32(len(packet.Payload))) >= 0 {
-		// dropped
+func (w *ReceiveWindow) insert(packet *streamPacket) {
+	if len(packet.Payload) == 0 {
+		//ignore empty data packet, e.g. a pure ack, which is not a retransmission
 		return
 	}
 
-	if len(packet.Payload) == 0 {
-		//ignore empty data packet
+	if w.expectBegin != 0 && compareTCPSeq(w.expectBegin, packet.Seq+uint32(len(packet.Payload))) >= 0 {
+		// dropped, already sent to the reader
+		w.metrics.onRetransmission()
 		return
 	}
 
@@ -47,6 +57,7 @@ func (w *ReceiveWindow) insert(packet *layers.TCP) {
 		result := compareTCPSeq(prev.Seq, packet.Seq)
 		if result == 0 {
 			// duplicated
+			w.metrics.onRetransmission()
 			return
 		}
 		if result < 0 {
@@ -65,6 +76,7 @@ func (w *ReceiveWindow) insert(packet *layers.TCP) {
 		w.buffer[index] = packet
 	} else {
 		// insert at index
+		w.metrics.onOutOfOrder()
 		for i := w.size - 1; i >= idx; i-- {
 			next := (i + w.start + 1) % len(w.buffer)
 			current := (i + w.start) % len(w.buffer)
@@ -78,7 +90,7 @@ func (w *ReceiveWindow) insert(packet *layers.TCP) {
 }
 
 // send confirmed packets to reader, when receive ack
-func (w *ReceiveWindow) confirm(ack uint32, c chan *layers.TCP) {
+func (w *ReceiveWindow) confirm(ack uint32, c chan *streamPacket) {
 	idx := 0
 	core.V2("confirm window size %v", w.size)
 	for ; idx < w.size; idx++ {
@@ -97,6 +109,7 @@ func (w *ReceiveWindow) confirm(ack uint32, c chan *layers.TCP) {
 				if duplicatedSize < 0 {
 					duplicatedSize += maxTCPSeq
 				}
+				w.metrics.onRetransmission()
 				if duplicatedSize >= uint32(len(packet.Payload)) {
 					continue
 				}
@@ -118,8 +131,17 @@ func (w *ReceiveWindow) confirm(ack uint32, c chan *layers.TCP) {
 	}
 }
 
+// send all the packets in the window to reader
+func (w *ReceiveWindow) confirmAll(c chan *streamPacket) {
+	if w.size == 0 {
+		return
+	}
+	last := w.buffer[(w.start+w.size-1)%len(w.buffer)]
+	w.confirm(last.Seq+uint32(len(last.Payload)), c)
+}
+
 func (w *ReceiveWindow) expand() {
-	buffer := make([]*layers.TCP, len(w.buffer)*2)
+	buffer := make([]*streamPacket, len(w.buffer)*2)
 	end := w.start + w.size
 	if end < len(w.buffer) {
 		copy(buffer, w.buffer[w.start:w.start+w.size])
@@ -0,0 +1,135 @@
+package httpdump
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// segments that were not looked up are dropped above this count, to limit the memory of unread streams
+const maxStreamTimeSegments = 4096
+
+// timedStream is a stream that knows the capture time of its bytes
+type timedStream interface {
+	io.ReadCloser
+	timeAt(offset int64) time.Time
+}
+
+// streamSegment is a range of stream bytes that were captured at the same time
+type streamSegment struct {
+	end       int64
+	timestamp time.Time
+}
+
+// streamTimes maps the offsets of a stream to the capture time of the packets that carried them.
+// The lookups of each stream are done in an increasing offset order, so the older segments are dropped.
+type streamTimes struct {
+	mutex    sync.Mutex
+	segments []streamSegment
+	length   int64
+}
+
+// add the next bytes of the stream
+func (t *streamTimes) add(length int, timestamp time.Time) {
+	if length == 0 {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.length += int64(length)
+	last := len(t.segments) - 1
+	if last >= 0 && t.segments[last].timestamp.Equal(timestamp) {
+		t.segments[last].end = t.length
+		return
+	}
+	if len(t.segments) >= maxStreamTimeSegments {
+		t.segments = append(t.segments[:0], t.segments[len(t.segments)/2:]...)
+	}
+	t.segments = append(t.segments, streamSegment{end: t.length, timestamp: timestamp})
+}
+
+// timeAt returns the capture time of the byte in the offset,
+// or the time of the closest known byte if the offset is out of the known range
+func (t *streamTimes) timeAt(offset int64) time.Time {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.segments) == 0 {
+		return time.Time{}
+	}
+	drop := 0
+	for drop < len(t.segments)-1 && t.segments[drop].end <= offset {
+		drop++
+	}
+	t.segments = t.segments[drop:]
+	return t.segments[0].timestamp
+}
+
+// streamClock is a buffered reader of a timed stream, that tracks the offset of the next unread byte.
+// It can also record the bytes that are read, to keep the wire form of a parsed message head.
+type streamClock struct {
+	*bufio.Reader
+	stream      timedStream
+	read        int64
+	recording   *bytes.Buffer
+	recordStart int64
+}
+
+func newStreamClock(stream timedStream) *streamClock {
+	clock := &streamClock{stream: stream}
+	clock.Reader = bufio.NewReader(readerFunc(clock.readStream))
+	return clock
+}
+
+func (c *streamClock) readStream(p []byte) (int, error) {
+	n, err := c.stream.Read(p)
+	c.read += int64(n)
+	if c.recording != nil {
+		c.recording.Write(p[:n])
+	}
+	return n, err
+}
+
+// startRecording records the bytes that are read from the current position
+func (c *streamClock) startRecording() {
+	c.recordStart = c.position()
+	c.recording = new(bytes.Buffer)
+	// the buffered bytes were read from the stream before the recording started
+	buffered, _ := c.Peek(c.Buffered())
+	c.recording.Write(buffered)
+}
+
+// stopRecording returns the bytes that were read since the recording started
+func (c *streamClock) stopRecording() []byte {
+	recorded := c.recording.Bytes()
+	c.recording = nil
+	length := c.position() - c.recordStart
+	if int64(len(recorded)) > length {
+		recorded = recorded[:length]
+	}
+	return recorded
+}
+
+// position returns the offset of the next byte to be read from the buffered reader
+func (c *streamClock) position() int64 {
+	return c.read - int64(c.Buffered())
+}
+
+// timeAt returns the capture time of the byte in the offset
+func (c *streamClock) timeAt(offset int64) time.Time {
+	return c.stream.timeAt(offset)
+}
+
+// lastByteTime returns the capture time of the last byte that was read
+func (c *streamClock) lastByteTime() time.Time {
+	return c.timeAt(c.position() - 1)
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,103 @@
+package httpdump
+
+import (
+	"github.com/alonana/httshark/core"
+	"github.com/google/gopacket/layers"
+	"io"
+	"testing"
+	"time"
+)
+
+// testStream is a timed stream over a reader, the capture times are the ones added to its times
+type testStream struct {
+	io.Reader
+	times streamTimes
+}
+
+func untimed(reader io.Reader) *testStream {
+	return &testStream{Reader: reader}
+}
+
+func (s *testStream) Close() error {
+	return nil
+}
+
+func (s *testStream) timeAt(offset int64) time.Time {
+	return s.times.timeAt(offset)
+}
+
+func TestStreamTimes(t *testing.T) {
+	base := time.Unix(1000, 0)
+	var times streamTimes
+	times.add(10, base)
+	times.add(5, base.Add(time.Second))
+	times.add(5, base.Add(time.Second))
+	times.add(10, base.Add(2*time.Second))
+
+	expected := []struct {
+		offset int64
+		time   time.Time
+	}{
+		{0, base},
+		{9, base},
+		{10, base.Add(time.Second)},
+		{19, base.Add(time.Second)},
+		{20, base.Add(2 * time.Second)},
+		{100, base.Add(2 * time.Second)},
+	}
+	for _, e := range expected {
+		if actual := times.timeAt(e.offset); !actual.Equal(e.time) {
+			t.Fatalf("offset %v expected time %v, but got %v", e.offset, e.time, actual)
+		}
+	}
+}
+
+func tcpPacket(seq uint32, ack uint32, payload string) *layers.TCP {
+	packet := &layers.TCP{Seq: seq, Ack: ack, ACK: ack != 0}
+	packet.Payload = []byte(payload)
+	return packet
+}
+
+func initStreamConfig() {
+	core.Config.NetworkStreamChannelSize = 16
+	core.Config.NetworkStreamChannelTimeout = time.Second
+	core.Config.FullChannelTimeout = time.Second
+	core.Config.ResponseTimeout = time.Second
+}
+
+func TestTransactionTimes(t *testing.T) {
+	initStreamConfig()
+
+	client := Endpoint{ip: "10.0.0.1", port: 50000}
+	server := Endpoint{ip: "10.0.0.2", port: 80}
+	base := time.Unix(1000, 0)
+	requestHeaders := "POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\n\r\n"
+	responseHeaders := "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n"
+
+	connection := newTCPConnection("test", nil)
+	connection.onReceive(client, tcpPacket(1, 0, requestHeaders), base)
+	connection.onReceive(client, tcpPacket(1+uint32(len(requestHeaders)), 0, "body"), base.Add(time.Second))
+	connection.onReceive(server, tcpPacket(1, 5+uint32(len(requestHeaders)), responseHeaders), base.Add(3*time.Second))
+	connection.onReceive(server, tcpPacket(1+uint32(len(responseHeaders)), 0, "hello"), base.Add(4*time.Second))
+	connection.forceClose()
+
+	transactions := collectTransactions(t, func() {
+		h := &HTTPTrafficHandler{originalKey: "test", key: ConnectionKey{client, server}}
+		h.handle(connection)
+	})
+
+	if len(transactions) != 1 || transactions[0].Response == nil {
+		t.Fatalf("expected 1 transaction, but got %+v", transactions)
+	}
+	request := transactions[0].Request
+	response := transactions[0].Response
+	if request.Data != "body" || response.Data != "hello" {
+		t.Fatalf("wrong transaction %+v", transactions[0])
+	}
+	if !request.Time.Equal(base) || !request.EndTime.Equal(base.Add(time.Second)) {
+		t.Fatalf("wrong request times %v - %v", request.Time, request.EndTime)
+	}
+	if !response.Time.Equal(base.Add(3*time.Second)) || !response.EndTime.Equal(base.Add(4*time.Second)) {
+		t.Fatalf("wrong response times %v - %v", response.Time, response.EndTime)
+	}
+}
@@ -19,19 +19,28 @@ const tcpSeqWindow = 0x0000FFFF
 type TCPAssembler struct {
 	connectionDict map[string]*TCPConnection
 	lock           sync.Mutex
+	hosts          *core.Hosts
+	tlsHosts       *core.Hosts
 }
 
 func newTCPAssembler() *TCPAssembler {
 	return &TCPAssembler{
 		connectionDict: map[string]*TCPConnection{},
+		hosts:          core.CapturedHosts(),
+		tlsHosts:       core.TLSHosts(),
 	}
 }
 
-func (assembler *TCPAssembler) assemble(flow gopacket.Flow, tcp *layers.TCP, timestamp time.Time) {
+func (assembler *TCPAssembler) assemble(flow gopacket.Flow, tcp *layers.TCP, tunnel *core.HttpTunnel, timestamp time.Time) {
 	core.V2("received packet")
 	src := Endpoint{ip: flow.Src().String(), port: uint16(tcp.SrcPort)}
 	dst := Endpoint{ip: flow.Dst().String(), port: uint16(tcp.DstPort)}
 
+	// the capture filter cannot look into the tunnels, so filter their inner packets here
+	if tunnel != nil && !assembler.hosts.Match(src.ip, int(src.port)) && !assembler.hosts.Match(dst.ip, int(dst.port)) {
+		return
+	}
+
 	srcString := src.String()
 	dstString := dst.String()
 	var key string
@@ -40,9 +49,10 @@ func (assembler *TCPAssembler) assemble(flow gopacket.Flow, tcp *layers.TCP, tim
 	} else {
 		key = dstString + "-" + srcString
 	}
+	key = tunnelKey(tunnel) + key
 
-	var createNewConn = tcp.SYN && !tcp.ACK || isHTTPRequestData(tcp.Payload)
-	connection := assembler.retrieveConnection(src, dst, key, createNewConn)
+	var createNewConn = tcp.SYN && !tcp.ACK || isHTTPRequestData(tcp.Payload) || isTLSClientHello(tcp.Payload)
+	connection := assembler.retrieveConnection(src, dst, key, tunnel, createNewConn)
 	if connection == nil {
 		core.V2("connection %v not located", key)
 		return
@@ -58,13 +68,14 @@ func (assembler *TCPAssembler) assemble(flow gopacket.Flow, tcp *layers.TCP, tim
 }
 
 // get connection this packet belong to; create new one if is new connection
-func (assembler *TCPAssembler) retrieveConnection(src, dst Endpoint, key string, init bool) *TCPConnection {
+func (assembler *TCPAssembler) retrieveConnection(src, dst Endpoint, key string, tunnel *core.HttpTunnel, init bool) *TCPConnection {
 	assembler.lock.Lock()
 	defer assembler.lock.Unlock()
 	connection := assembler.connectionDict[key]
 	if connection == nil {
 		if init {
-			connection = newTCPConnection(key)
+			connection = newTCPConnection(key, tunnel)
+			connection.tls = assembler.isTLS(dst)
 			assembler.connectionDict[key] = connection
 			newHttpTrafficHandler(key, src, dst, connection)
 			core.V2("creating connection %v", key)
@@ -73,6 +84,11 @@ func (assembler *TCPAssembler) retrieveConnection(src, dst Endpoint, key string,
 	return connection
 }
 
+// if the connection to the server should be decrypted
+func (assembler *TCPAssembler) isTLS(server Endpoint) bool {
+	return assembler.tlsHosts != nil && assembler.tlsHosts.Match(server.ip, int(server.port))
+}
+
 // remove connection (when is closed or timeout)
 func (assembler *TCPAssembler) deleteConnection(key string) {
 	assembler.lock.Lock()
@@ -99,8 +115,24 @@ func (assembler *TCPAssembler) flushOlderThan(time time.Time) {
 	}
 }
 
+// flush all connections, used when no more packets are expected. Returns the number of flushed connections.
+func (assembler *TCPAssembler) flushAll() int {
+	var connections []*TCPConnection
+	assembler.lock.Lock()
+	for key, connection := range assembler.connectionDict {
+		connections = append(connections, connection)
+		delete(assembler.connectionDict, key)
+	}
+	assembler.lock.Unlock()
+
+	for _, connection := range connections {
+		connection.forceClose()
+	}
+	return len(connections)
+}
+
 var httpMethods = map[string]bool{"GET": true, "POST": true, "PUT": true, "DELETE": true, "HEAD": true,
-	"TRACE": true, "OPTIONS": true, "PATCH": true}
+	"TRACE": true, "OPTIONS": true, "PATCH": true, "PRI": true}
 
 // if is first http request packet
 func isHTTPRequestData(body []byte) bool {
@@ -14,14 +14,20 @@ type TCPConnection struct {
 	lastTimestamp time.Time      // timestamp receive last packet
 	isHTTP        bool
 	key           string
+	tunnel        *core.HttpTunnel // the outer encapsulation, nil if not encapsulated
+	tls           bool             // the connection is decrypted using the TLS key log
+	metrics       *tcpMetrics
 }
 
 // create tcp connection, by the first tcp packet. this packet should from client to server
-func newTCPConnection(key string) *TCPConnection {
+func newTCPConnection(key string, tunnel *core.HttpTunnel) *TCPConnection {
+	metrics := newTCPMetrics()
 	connection := &TCPConnection{
-		upStream:   newNetworkStream("up " + key),
-		downStream: newNetworkStream("down " + key),
+		upStream:   newNetworkStream("up "+key, metrics),
+		downStream: newNetworkStream("down "+key, metrics),
 		key:        key,
+		tunnel:     tunnel,
+		metrics:    metrics,
 	}
 
 	connection.upStream.opposite = connection.downStream
@@ -34,10 +40,11 @@ func newTCPConnection(key string) *TCPConnection {
 func (connection *TCPConnection) onReceive(src Endpoint, tcp *layers.TCP, timestamp time.Time) {
 	core.V2("connection %v receive", connection.key)
 	connection.lastTimestamp = timestamp
+	connection.metrics.onPacket(src, tcp, timestamp)
 	payload := tcp.Payload
 	if !connection.isHTTP {
 		// skip no-http data
-		if !isHTTPRequestData(payload) {
+		if connection.tls && !isTLSClientHello(payload) || !connection.tls && !isHTTPRequestData(payload) {
 			core.V2("skip non HTTP data")
 			return
 		}
@@ -55,7 +62,7 @@ func (connection *TCPConnection) onReceive(src Endpoint, tcp *layers.TCP, timest
 		confirmStream = connection.upStream
 	}
 
-	sendStream.appendPacket(tcp)
+	sendStream.appendPacket(tcp, timestamp)
 
 	if tcp.ACK {
 		confirmStream.confirmPacket(tcp.Ack)
@@ -67,8 +74,19 @@ func (connection *TCPConnection) onReceive(src Endpoint, tcp *layers.TCP, timest
 	}
 }
 
+// readers returns the readers of the client and the server data, decrypted in case of a TLS connection
+func (connection *TCPConnection) readers() (timedStream, timedStream) {
+	if connection.tls {
+		return newTLSReaders(connection)
+	}
+	return connection.upStream, connection.downStream
+}
+
 func (connection *TCPConnection) forceClose() {
 	core.V2("%v tcp connection - force close", connection.key)
+	// deliver the data that was captured, but its ACK was not
+	connection.upStream.confirmAll()
+	connection.downStream.confirmAll()
 	connection.upStream.closed = true
 	connection.downStream.closed = true
 	connection.finish()
@@ -0,0 +1,97 @@
+package httpdump
+
+import (
+	"github.com/alonana/httshark/core"
+	"github.com/google/gopacket/layers"
+	"sync"
+	"time"
+)
+
+// tcpMetrics counts the TCP quality events of a connection.
+// The counters are updated by the assembler, and taken by the traffic handler for each transaction.
+type tcpMetrics struct {
+	mutex           sync.Mutex
+	retransmissions int
+	outOfOrder      int
+	zeroWindows     int
+	zeroWindow      map[Endpoint]bool // the endpoints currently advertising a zero window
+
+	handshakeClient Endpoint
+	synTime         time.Time
+	synAck          bool
+	handshakeRTT    time.Duration
+	handshakeTaken  bool
+}
+
+func newTCPMetrics() *tcpMetrics {
+	return &tcpMetrics{zeroWindow: make(map[Endpoint]bool)}
+}
+
+func (m *tcpMetrics) onRetransmission() {
+	m.mutex.Lock()
+	m.retransmissions++
+	m.mutex.Unlock()
+}
+
+func (m *tcpMetrics) onOutOfOrder() {
+	m.mutex.Lock()
+	m.outOfOrder++
+	m.mutex.Unlock()
+}
+
+// onPacket tracks the handshake and the window of the endpoints
+func (m *tcpMetrics) onPacket(src Endpoint, tcp *layers.TCP, timestamp time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	switch {
+	case tcp.SYN && !tcp.ACK:
+		if m.synTime.IsZero() {
+			m.handshakeClient = src
+			m.synTime = timestamp
+		} else {
+			m.retransmissions++
+		}
+	case tcp.SYN && tcp.ACK:
+		m.synAck = !m.synTime.IsZero()
+	case tcp.ACK && m.synAck && m.handshakeRTT == 0 && m.handshakeClient.equals(src):
+		m.handshakeRTT = timestamp.Sub(m.synTime)
+	}
+
+	if tcp.RST || tcp.SYN {
+		return
+	}
+	// a zero window event is counted once, until the window is opened
+	if tcp.Window == 0 {
+		if !m.zeroWindow[src] {
+			m.zeroWindow[src] = true
+			m.zeroWindows++
+		}
+	} else {
+		m.zeroWindow[src] = false
+	}
+}
+
+// take returns the metrics, and resets the counters for the next transaction.
+// The handshake RTT is returned only to the first transaction, so it is counted once for each connection.
+func (m *tcpMetrics) take() *core.HttpTcpMetrics {
+	if m == nil {
+		return nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	metrics := &core.HttpTcpMetrics{
+		Retransmissions: m.retransmissions,
+		OutOfOrder:      m.outOfOrder,
+		ZeroWindows:     m.zeroWindows,
+	}
+	if !m.handshakeTaken {
+		metrics.HandshakeRTT = m.handshakeRTT
+		m.handshakeTaken = true
+	}
+	m.retransmissions = 0
+	m.outOfOrder = 0
+	m.zeroWindows = 0
+	return metrics
+}
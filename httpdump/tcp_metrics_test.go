@@ -0,0 +1,76 @@
+package httpdump
+
+import (
+	"github.com/google/gopacket/layers"
+	"testing"
+	"time"
+)
+
+func TestTCPMetrics(t *testing.T) {
+	initStreamConfig()
+	client := Endpoint{ip: "10.0.0.1", port: 50000}
+	server := Endpoint{ip: "10.0.0.2", port: 80}
+	base := time.Unix(1000, 0)
+
+	connection := newTCPConnection("test", nil)
+	connection.onReceive(client, &layers.TCP{SYN: true, Window: 1000}, base)
+	connection.onReceive(server, &layers.TCP{SYN: true, ACK: true, Window: 1000}, base.Add(10*time.Millisecond))
+	connection.onReceive(client, &layers.TCP{ACK: true, Window: 1000}, base.Add(12*time.Millisecond))
+
+	packet := func(seq uint32, payload string) *layers.TCP {
+		p := tcpPacket(seq, 0, payload)
+		p.Window = 1000
+		return p
+	}
+	connection.onReceive(client, packet(1, "GET / HT"), base)
+	// out of order, and then retransmitted
+	connection.onReceive(client, packet(17, "\r\n\r\n"), base)
+	connection.onReceive(client, packet(9, "TP/1.1\r\n"), base)
+	connection.onReceive(client, packet(17, "\r\n\r\n"), base)
+
+	// the server advertises a zero window twice in a row, and then opens it
+	zeroWindow := &layers.TCP{ACK: true, Ack: 21}
+	connection.onReceive(server, zeroWindow, base)
+	connection.onReceive(server, zeroWindow, base)
+	connection.onReceive(server, &layers.TCP{ACK: true, Ack: 21, Window: 1000}, base)
+	// the delivered data is sent again
+	connection.onReceive(client, packet(1, "GET / HT"), base)
+
+	metrics := connection.metrics.take()
+	if metrics.HandshakeRTT != 12*time.Millisecond || metrics.Retransmissions != 2 ||
+		metrics.OutOfOrder != 1 || metrics.ZeroWindows != 1 {
+		t.Fatalf("wrong metrics %+v", metrics)
+	}
+
+	// the handshake is reported only with the first transaction of the connection
+	metrics = connection.metrics.take()
+	if metrics.HandshakeRTT != 0 || metrics.Retransmissions != 0 ||
+		metrics.OutOfOrder != 0 || metrics.ZeroWindows != 0 {
+		t.Fatalf("metrics are not reset %+v", metrics)
+	}
+}
+
+func TestTCPMetricsPureAcks(t *testing.T) {
+	initStreamConfig()
+	client := Endpoint{ip: "10.0.0.1", port: 50000}
+	server := Endpoint{ip: "10.0.0.2", port: 80}
+	base := time.Unix(1000, 0)
+
+	connection := newTCPConnection("test", nil)
+	request := tcpPacket(1, 0, "GET / HTTP/1.1\r\n\r\n")
+	request.Window = 1000
+	connection.onReceive(client, request, base)
+	// the server acks the request, so it is sent to the reader
+	connection.onReceive(server, &layers.TCP{ACK: true, Ack: 1 + uint32(len(request.Payload)), Window: 1000}, base)
+	// the client acks the response data without sending data, at the next expected sequence
+	for i := 0; i < 5; i++ {
+		ack := tcpPacket(1+uint32(len(request.Payload)), uint32(100*(i+1)), "")
+		ack.Window = 1000
+		connection.onReceive(client, ack, base)
+	}
+
+	metrics := connection.metrics.take()
+	if metrics.Retransmissions != 0 {
+		t.Fatalf("pure acks should not be counted as retransmissions %+v", metrics)
+	}
+}
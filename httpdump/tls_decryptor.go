@@ -0,0 +1,523 @@
+package httpdump
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"github.com/alonana/httshark/core"
+	"github.com/alonana/httshark/core/aggregated"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"hash"
+	"io"
+	"sync"
+	"time"
+)
+
+const tlsRecordHeaderLength = 5
+const tlsMaxRecordLength = 16384 + 2048
+
+const tlsRecordChangeCipherSpec = 20
+const tlsRecordHandshake = 22
+const tlsRecordApplicationData = 23
+
+const tlsHandshakeClientHello = 1
+const tlsHandshakeServerHello = 2
+const tlsHandshakeFinished = 20
+const tlsHandshakeKeyUpdate = 24
+
+const tlsVersion12 = 0x0303
+const tlsVersion13 = 0x0304
+
+const tlsExtensionSupportedVersions = 0x002b
+
+// a server hello with this random is a TLS 1.3 hello retry request
+var helloRetryRequestRandom = []byte{
+	0xCF, 0x21, 0xAD, 0x74, 0xE5, 0x9A, 0x61, 0x11, 0xBE, 0x1D, 0x8C, 0x02, 0x1E, 0x65, 0xB8, 0x91,
+	0xC2, 0xA2, 0x11, 0x16, 0x7A, 0xBB, 0x8C, 0x5E, 0x07, 0x9E, 0x09, 0xE2, 0xC8, 0xA8, 0x33, 0x9C,
+}
+
+// tlsSuite is an AEAD cipher suite.
+// For TLS 1.2 AES-GCM the IV is the 4 bytes implicit nonce, and the rest of the nonce is sent in the record.
+type tlsSuite struct {
+	keyLength int
+	ivLength  int
+	hash      func() hash.Hash
+	aead      func(key []byte) (cipher.AEAD, error)
+}
+
+var aes128GcmSha256 = tlsSuite{keyLength: 16, ivLength: 4, hash: sha256.New, aead: newAesGcm}
+var aes256GcmSha384 = tlsSuite{keyLength: 32, ivLength: 4, hash: sha512.New384, aead: newAesGcm}
+var chacha20Poly1305Sha256 = tlsSuite{keyLength: 32, ivLength: 12, hash: sha256.New, aead: chacha20poly1305.New}
+
+var tls12Suites = map[uint16]tlsSuite{
+	0x009C: aes128GcmSha256,        // TLS_RSA_WITH_AES_128_GCM_SHA256
+	0x009D: aes256GcmSha384,        // TLS_RSA_WITH_AES_256_GCM_SHA384
+	0x009E: aes128GcmSha256,        // TLS_DHE_RSA_WITH_AES_128_GCM_SHA256
+	0x009F: aes256GcmSha384,        // TLS_DHE_RSA_WITH_AES_256_GCM_SHA384
+	0xC02B: aes128GcmSha256,        // TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+	0xC02C: aes256GcmSha384,        // TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384
+	0xC02F: aes128GcmSha256,        // TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	0xC030: aes256GcmSha384,        // TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+	0xCCA8: chacha20Poly1305Sha256, // TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256
+	0xCCA9: chacha20Poly1305Sha256, // TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256
+	0xCCAA: chacha20Poly1305Sha256, // TLS_DHE_RSA_WITH_CHACHA20_POLY1305_SHA256
+}
+
+var tls13Suites = map[uint16]tlsSuite{
+	0x1301: {keyLength: 16, ivLength: 12, hash: sha256.New, aead: newAesGcm},            // TLS_AES_128_GCM_SHA256
+	0x1302: {keyLength: 32, ivLength: 12, hash: sha512.New384, aead: newAesGcm},         // TLS_AES_256_GCM_SHA384
+	0x1303: {keyLength: 32, ivLength: 12, hash: sha256.New, aead: chacha20poly1305.New}, // TLS_CHACHA20_POLY1305_SHA256
+}
+
+func newAesGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// if is the first packet of a TLS connection
+func isTLSClientHello(body []byte) bool {
+	return len(body) > tlsRecordHeaderLength && body[0] == tlsRecordHandshake && body[1] == 3 &&
+		body[tlsRecordHeaderLength] == tlsHandshakeClientHello
+}
+
+// tlsSession holds the handshake parameters, that are shared by the two directions of a TLS connection
+type tlsSession struct {
+	key          string
+	keyLog       *keyLog
+	mutex        sync.Mutex
+	hellos       *sync.Cond
+	clientRandom []byte
+	serverRandom []byte
+	version      uint16
+	cipherSuite  uint16
+	serverHello  bool
+	ended        bool
+}
+
+// tlsStreamReader reads the decrypted data of one direction.
+// The capture time of a decrypted byte is the capture time of the last byte of its record.
+type tlsStreamReader struct {
+	*io.PipeReader
+	stream timedStream
+	times  streamTimes
+}
+
+func (r *tlsStreamReader) Close() error {
+	_ = r.stream.Close()
+	return r.PipeReader.Close()
+}
+
+func (r *tlsStreamReader) timeAt(offset int64) time.Time {
+	return r.times.timeAt(offset)
+}
+
+// newTLSReaders starts decrypting the streams of the connection,
+// and returns the readers of the decrypted client and server data
+func newTLSReaders(connection *TCPConnection) (timedStream, timedStream) {
+	session := &tlsSession{
+		key:    connection.key,
+		keyLog: getKeyLog(),
+	}
+	session.hellos = sync.NewCond(&session.mutex)
+	return session.start(connection.upStream, true), session.start(connection.downStream, false)
+}
+
+// start decrypting the stream, and return the reader of the decrypted data
+func (s *tlsSession) start(stream timedStream, client bool) *tlsStreamReader {
+	reader, writer := io.Pipe()
+	plain := &tlsStreamReader{PipeReader: reader, stream: stream}
+	direction := &tlsDirection{session: s, client: client, times: &plain.times}
+	go direction.run(stream, writer)
+	return plain
+}
+
+// waitForHellos waits until both the client hello and the server hello were parsed,
+// and returns the negotiated version, or zero if one of the directions ended before its hello
+func (s *tlsSession) waitForHellos() uint16 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for (s.clientRandom == nil || !s.serverHello) && !s.ended {
+		s.hellos.Wait()
+	}
+	if s.clientRandom == nil || !s.serverHello {
+		return 0
+	}
+	return s.version
+}
+
+func (s *tlsSession) update(update func()) {
+	s.mutex.Lock()
+	update()
+	s.mutex.Unlock()
+	s.hellos.Broadcast()
+}
+
+// tlsDirection decrypts the records of one direction of the connection
+type tlsDirection struct {
+	session       *tlsSession
+	client        bool
+	cipher        *tlsRecordCipher
+	suite         tlsSuite
+	handshake     []byte
+	trafficSecret []byte
+	application   bool
+	times         *streamTimes
+}
+
+func (d *tlsDirection) name() string {
+	if d.client {
+		return "client"
+	}
+	return "server"
+}
+
+func (d *tlsDirection) run(stream timedStream, plain *io.PipeWriter) {
+	reader := newStreamClock(stream)
+	d.decryptRecords(reader, plain)
+
+	d.session.update(func() { d.session.ended = true })
+	_ = plain.Close()
+	// keep consuming the stream, so the capture is not blocked after a decryption failure
+	discardAll(reader)
+}
+
+func (d *tlsDirection) decryptRecords(reader *streamClock, plain io.Writer) {
+	header := make([]byte, tlsRecordHeaderLength)
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err != nil {
+			return
+		}
+		length := int(binary.BigEndian.Uint16(header[3:5]))
+		if length > tlsMaxRecordLength {
+			aggregated.Warn("invalid TLS %v record length %v", d.name(), length)
+			return
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(reader, payload)
+		if err != nil {
+			return
+		}
+
+		data, err := d.processRecord(header, payload)
+		if err != nil {
+			core.V2("%v TLS %v decryption failed: %v", d.session.key, d.name(), err)
+			aggregated.Warn("TLS %v decryption failed: %v", d.name(), core.LimitedError(err))
+			return
+		}
+		if len(data) > 0 {
+			d.times.add(len(data), reader.lastByteTime())
+			_, err = plain.Write(data)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (d *tlsDirection) processRecord(header []byte, payload []byte) ([]byte, error) {
+	if d.cipher == nil {
+		switch header[0] {
+		case tlsRecordHandshake:
+			return nil, d.processHandshake(payload)
+		case tlsRecordChangeCipherSpec:
+			// TLS 1.3 sends it only for middlebox compatibility
+			version := d.session.waitForHellos()
+			if version == tlsVersion13 {
+				return nil, nil
+			}
+			return nil, d.startTLS12(version)
+		case tlsRecordApplicationData:
+			version := d.session.waitForHellos()
+			if version != tlsVersion13 {
+				return nil, fmt.Errorf("application data before change cipher spec")
+			}
+			label := keyLogServerHandshakeSecret
+			if d.client {
+				label = keyLogClientHandshakeSecret
+			}
+			err := d.startTLS13(label)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, nil
+		}
+	}
+
+	plaintext, contentType, err := d.cipher.decrypt(header, payload)
+	if err != nil {
+		return nil, err
+	}
+	switch contentType {
+	case tlsRecordApplicationData:
+		return plaintext, nil
+	case tlsRecordHandshake:
+		return nil, d.processHandshake(plaintext)
+	}
+	return nil, nil
+}
+
+// processHandshake parses the handshake messages, that might be split between several records
+func (d *tlsDirection) processHandshake(data []byte) error {
+	d.handshake = append(d.handshake, data...)
+	for len(d.handshake) >= 4 {
+		length := int(d.handshake[1])<<16 | int(d.handshake[2])<<8 | int(d.handshake[3])
+		if len(d.handshake) < 4+length {
+			return nil
+		}
+		messageType := d.handshake[0]
+		message := d.handshake[4 : 4+length]
+		d.handshake = d.handshake[4+length:]
+
+		err := d.processHandshakeMessage(messageType, message)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *tlsDirection) processHandshakeMessage(messageType byte, message []byte) error {
+	switch messageType {
+	case tlsHandshakeClientHello:
+		if !d.client || len(message) < 34 {
+			return nil
+		}
+		random := append([]byte(nil), message[2:34]...)
+		d.session.update(func() { d.session.clientRandom = random })
+	case tlsHandshakeServerHello:
+		if d.client {
+			return nil
+		}
+		return d.parseServerHello(message)
+	case tlsHandshakeFinished:
+		if d.cipher == nil || d.cipher.version != tlsVersion13 || d.application {
+			return nil
+		}
+		// the next records are encrypted by the application traffic secret
+		d.application = true
+		label := keyLogServerTrafficSecret
+		if d.client {
+			label = keyLogClientTrafficSecret
+		}
+		return d.startTLS13(label)
+	case tlsHandshakeKeyUpdate:
+		if d.cipher == nil || d.cipher.version != tlsVersion13 {
+			return nil
+		}
+		next := hkdfExpandLabel(d.suite.hash, d.trafficSecret, "traffic upd", d.suite.hash().Size())
+		return d.setTrafficSecret(next)
+	}
+	return nil
+}
+
+func (d *tlsDirection) parseServerHello(message []byte) error {
+	if len(message) < 35 {
+		return fmt.Errorf("server hello truncated")
+	}
+	version := binary.BigEndian.Uint16(message[0:2])
+	random := append([]byte(nil), message[2:34]...)
+	if bytes.Equal(random, helloRetryRequestRandom) {
+		return nil
+	}
+
+	offset := 35 + int(message[34])
+	if len(message) < offset+3 {
+		return fmt.Errorf("server hello truncated")
+	}
+	cipherSuite := binary.BigEndian.Uint16(message[offset : offset+2])
+	offset += 3
+
+	if len(message) >= offset+2 {
+		extensionsEnd := offset + 2 + int(binary.BigEndian.Uint16(message[offset:offset+2]))
+		offset += 2
+		for offset+4 <= extensionsEnd && extensionsEnd <= len(message) {
+			extensionType := binary.BigEndian.Uint16(message[offset : offset+2])
+			extensionLength := int(binary.BigEndian.Uint16(message[offset+2 : offset+4]))
+			offset += 4
+			if extensionType == tlsExtensionSupportedVersions && extensionLength == 2 && offset+2 <= len(message) {
+				version = binary.BigEndian.Uint16(message[offset : offset+2])
+			}
+			offset += extensionLength
+		}
+	}
+
+	d.session.update(func() {
+		d.session.version = version
+		d.session.serverRandom = random
+		d.session.cipherSuite = cipherSuite
+		d.session.serverHello = true
+	})
+	return nil
+}
+
+// startTLS12 derives the keys of the direction from the master secret
+func (d *tlsDirection) startTLS12(version uint16) error {
+	if version != tlsVersion12 {
+		return fmt.Errorf("unsupported TLS version 0x%04x", version)
+	}
+	suite, exists := tls12Suites[d.session.cipherSuite]
+	if !exists {
+		return fmt.Errorf("unsupported TLS 1.2 cipher suite 0x%04x", d.session.cipherSuite)
+	}
+	masterSecret := d.session.keyLog.secret(keyLogMasterSecret, d.session.clientRandom)
+	if masterSecret == nil {
+		return fmt.Errorf("master secret not found in the key log")
+	}
+
+	seed := append(append([]byte(nil), d.session.serverRandom...), d.session.clientRandom...)
+	keyBlock := prf12(suite.hash, masterSecret, "key expansion", seed, 2*suite.keyLength+2*suite.ivLength)
+	clientKey := keyBlock[:suite.keyLength]
+	serverKey := keyBlock[suite.keyLength : 2*suite.keyLength]
+	clientIv := keyBlock[2*suite.keyLength : 2*suite.keyLength+suite.ivLength]
+	serverIv := keyBlock[2*suite.keyLength+suite.ivLength:]
+
+	key, iv := serverKey, serverIv
+	if d.client {
+		key, iv = clientKey, clientIv
+	}
+	aead, err := suite.aead(key)
+	if err != nil {
+		return err
+	}
+	d.suite = suite
+	d.cipher = &tlsRecordCipher{
+		aead:          aead,
+		iv:            iv,
+		version:       tlsVersion12,
+		explicitNonce: suite.ivLength < aead.NonceSize(),
+	}
+	return nil
+}
+
+// startTLS13 sets the direction keys using the traffic secret of the label
+func (d *tlsDirection) startTLS13(label string) error {
+	suite, exists := tls13Suites[d.session.cipherSuite]
+	if !exists {
+		return fmt.Errorf("unsupported TLS 1.3 cipher suite 0x%04x", d.session.cipherSuite)
+	}
+	secret := d.session.keyLog.secret(label, d.session.clientRandom)
+	if secret == nil {
+		return fmt.Errorf("%v not found in the key log", label)
+	}
+	d.suite = suite
+	return d.setTrafficSecret(secret)
+}
+
+func (d *tlsDirection) setTrafficSecret(secret []byte) error {
+	key := hkdfExpandLabel(d.suite.hash, secret, "key", d.suite.keyLength)
+	iv := hkdfExpandLabel(d.suite.hash, secret, "iv", d.suite.ivLength)
+	aead, err := d.suite.aead(key)
+	if err != nil {
+		return err
+	}
+	d.trafficSecret = secret
+	d.cipher = &tlsRecordCipher{
+		aead:    aead,
+		iv:      iv,
+		version: tlsVersion13,
+	}
+	return nil
+}
+
+// tlsRecordCipher decrypts the records of one direction using the direction key
+type tlsRecordCipher struct {
+	aead          cipher.AEAD
+	iv            []byte
+	sequence      uint64
+	version       uint16
+	explicitNonce bool
+}
+
+// decrypt the record, and return its plaintext and content type
+func (c *tlsRecordCipher) decrypt(header []byte, payload []byte) ([]byte, byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	copy(nonce, c.iv)
+	ciphertext := payload
+	if c.explicitNonce {
+		explicitLength := len(nonce) - len(c.iv)
+		if len(payload) < explicitLength {
+			return nil, 0, fmt.Errorf("record truncated")
+		}
+		copy(nonce[len(c.iv):], payload[:explicitLength])
+		ciphertext = payload[explicitLength:]
+	} else {
+		for i := 0; i < 8; i++ {
+			nonce[len(nonce)-1-i] ^= byte(c.sequence >> (8 * uint(i)))
+		}
+	}
+	if len(ciphertext) < c.aead.Overhead() {
+		return nil, 0, fmt.Errorf("record truncated")
+	}
+
+	additionalData := header
+	if c.version == tlsVersion12 {
+		additionalData = make([]byte, 13)
+		binary.BigEndian.PutUint64(additionalData, c.sequence)
+		copy(additionalData[8:11], header[0:3])
+		binary.BigEndian.PutUint16(additionalData[11:], uint16(len(ciphertext)-c.aead.Overhead()))
+	}
+
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, 0, err
+	}
+	c.sequence++
+
+	if c.version == tlsVersion12 {
+		return plaintext, header[0], nil
+	}
+
+	// the TLS 1.3 inner content type follows the content, and is followed by zeros padding
+	i := len(plaintext) - 1
+	for i >= 0 && plaintext[i] == 0 {
+		i--
+	}
+	if i < 0 {
+		return nil, 0, fmt.Errorf("missing inner content type")
+	}
+	return plaintext[:i], plaintext[i], nil
+}
+
+// prf12 is the TLS 1.2 pseudo random function, see RFC 5246 section 5
+func prf12(hashFunc func() hash.Hash, secret []byte, label string, seed []byte, length int) []byte {
+	labelAndSeed := append([]byte(label), seed...)
+	result := make([]byte, 0, length)
+	mac := hmac.New(hashFunc, secret)
+	mac.Write(labelAndSeed)
+	a := mac.Sum(nil)
+	for len(result) < length {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(labelAndSeed)
+		result = append(result, mac.Sum(nil)...)
+
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+	return result[:length]
+}
+
+// hkdfExpandLabel is the TLS 1.3 key derivation, with an empty context, see RFC 8446 section 7.1
+func hkdfExpandLabel(hashFunc func() hash.Hash, secret []byte, label string, length int) []byte {
+	fullLabel := "tls13 " + label
+	info := make([]byte, 0, 4+len(fullLabel))
+	info = append(info, byte(length>>8), byte(length), byte(len(fullLabel)))
+	info = append(info, fullLabel...)
+	info = append(info, 0)
+
+	result := make([]byte, length)
+	_, _ = io.ReadFull(hkdf.Expand(hashFunc, secret, info), result)
+	return result
+}
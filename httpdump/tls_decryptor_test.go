@@ -0,0 +1,147 @@
+package httpdump
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+const tlsTestRequest = "GET /items?id=1 HTTP/1.1\r\nHost: example.com\r\n\r\n"
+const tlsTestResponse = "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+
+func TestTLS12Decryption(t *testing.T) {
+	config := &tls.Config{
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	}
+	checkTLSDecryption(t, config)
+}
+
+func TestTLS12ChachaDecryption(t *testing.T) {
+	config := &tls.Config{
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256},
+	}
+	checkTLSDecryption(t, config)
+}
+
+func TestTLS13Decryption(t *testing.T) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS13,
+	}
+	checkTLSDecryption(t, config)
+}
+
+func checkTLSDecryption(t *testing.T, config *tls.Config) {
+	keyLogFile, err := ioutil.TempFile("", "keylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyLogFile.Name())
+
+	upStream, downStream := recordTLSConnection(t, config, keyLogFile)
+	_ = keyLogFile.Close()
+
+	session := &tlsSession{
+		key:    "test",
+		keyLog: newKeyLog(keyLogFile.Name()),
+	}
+	session.hellos = sync.NewCond(&session.mutex)
+
+	var request []byte
+	var readWait sync.WaitGroup
+	readWait.Add(1)
+	go func() {
+		defer readWait.Done()
+		request, _ = ioutil.ReadAll(session.start(untimed(bytes.NewReader(upStream)), true))
+	}()
+	response, _ := ioutil.ReadAll(session.start(untimed(bytes.NewReader(downStream)), false))
+	readWait.Wait()
+
+	if string(request) != tlsTestRequest {
+		t.Fatalf("wrong decrypted request %q", request)
+	}
+	if string(response) != tlsTestResponse {
+		t.Fatalf("wrong decrypted response %q", response)
+	}
+}
+
+// recordedConn keeps the bytes written to the connection
+type recordedConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordedConn) Write(b []byte) (int, error) {
+	c.written.Write(b)
+	return c.Conn.Write(b)
+}
+
+// recordTLSConnection runs a request and a response over TLS, and returns the encrypted client and server streams
+func recordTLSConnection(t *testing.T, config *tls.Config, keyLogFile *os.File) ([]byte, []byte) {
+	clientPipe, serverPipe := net.Pipe()
+	clientConn := &recordedConn{Conn: clientPipe}
+	serverConn := &recordedConn{Conn: serverPipe}
+
+	serverConfig := config.Clone()
+	serverConfig.Certificates = []tls.Certificate{testCertificate(t)}
+	clientConfig := config.Clone()
+	clientConfig.InsecureSkipVerify = true
+	clientConfig.KeyLogWriter = keyLogFile
+
+	serverDone := make(chan error, 1)
+	go func() {
+		server := tls.Server(serverConn, serverConfig)
+		buffer := make([]byte, len(tlsTestRequest))
+		_, err := server.Read(buffer)
+		if err == nil {
+			_, err = server.Write([]byte(tlsTestResponse))
+		}
+		_ = server.Close()
+		serverDone <- err
+	}()
+
+	client := tls.Client(clientConn, clientConfig)
+	_, err := client.Write([]byte(tlsTestRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+	if err := <-serverDone; err != nil {
+		t.Fatal(err)
+	}
+	return clientConn.written.Bytes(), serverConn.written.Bytes()
+}
+
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{certificate}, PrivateKey: key}
+}
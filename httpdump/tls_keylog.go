@@ -0,0 +1,180 @@
+package httpdump
+
+import (
+	"bufio"
+	"encoding/hex"
+	"github.com/alonana/httshark/core"
+	"github.com/alonana/httshark/core/aggregated"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NSS key log labels, see https://developer.mozilla.org/en-US/docs/Mozilla/Projects/NSS/Key_Log_Format
+const keyLogMasterSecret = "CLIENT_RANDOM"
+const keyLogClientHandshakeSecret = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+const keyLogServerHandshakeSecret = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+const keyLogClientTrafficSecret = "CLIENT_TRAFFIC_SECRET_0"
+const keyLogServerTrafficSecret = "SERVER_TRAFFIC_SECRET_0"
+
+// the secrets are logged by the client or the server during the handshake,
+// so a missing secret is looked up again until this timeout
+const keyLogWaitTimeout = 2 * time.Second
+const keyLogWaitInterval = 100 * time.Millisecond
+
+// when capturing from an interface, the secrets are used shortly after they are logged,
+// so they are evicted after this age, as are the client randoms whose secrets were not found
+const keyLogMaxAge = 5 * time.Minute
+
+// keyLog holds the secrets of the key log file, by label and client random.
+// The file is reloaded when a secret is missing, as the secrets of new connections are appended to it.
+// A client random whose secret was not found is not waited for again, so a connection without logged keys
+// delays its decryptor only once.
+type keyLog struct {
+	path      string
+	mutex     sync.Mutex
+	secrets   map[string]keyLogSecret
+	missing   map[string]time.Time // the client randoms that were given up on
+	offset    int64
+	lastEvict time.Time
+}
+
+type keyLogSecret struct {
+	value  []byte
+	loaded time.Time
+}
+
+func newKeyLog(path string) *keyLog {
+	return &keyLog{
+		path:    path,
+		secrets: make(map[string]keyLogSecret),
+		missing: make(map[string]time.Time),
+	}
+}
+
+var tlsKeyLog *keyLog
+var tlsKeyLogOnce sync.Once
+
+// getKeyLog returns the configured key log, or nil if TLS decryption is not configured
+func getKeyLog() *keyLog {
+	tlsKeyLogOnce.Do(func() {
+		if core.Config.TLSKeyLog == "" {
+			return
+		}
+		tlsKeyLog = newKeyLog(core.Config.TLSKeyLog)
+		tlsKeyLog.load()
+	})
+	return tlsKeyLog
+}
+
+// secret returns the secret of the label and client random, or nil if it was not logged
+func (k *keyLog) secret(label string, clientRandom []byte) []byte {
+	random := hex.EncodeToString(clientRandom)
+	key := label + " " + random
+	waitStart := time.Now()
+	for {
+		k.mutex.Lock()
+		secret, exists := k.secrets[key]
+		if !exists {
+			k.load()
+			secret, exists = k.secrets[key]
+		}
+		if exists {
+			k.mutex.Unlock()
+			return secret.value
+		}
+		_, givenUp := k.missing[random]
+		if givenUp || time.Since(waitStart) > keyLogWaitTimeout {
+			if !givenUp {
+				k.missing[random] = time.Now()
+			}
+			k.mutex.Unlock()
+			return nil
+		}
+		k.mutex.Unlock()
+		time.Sleep(keyLogWaitInterval)
+	}
+}
+
+// evict the secrets and the missing client randoms above the max age.
+// The secrets of a pcap file are kept, as the file might be processed long after they are loaded.
+func (k *keyLog) evict() {
+	now := time.Now()
+	if core.Config.PcapFile != "" || now.Sub(k.lastEvict) < keyLogMaxAge/10 {
+		return
+	}
+	k.lastEvict = now
+	for key, secret := range k.secrets {
+		if now.Sub(secret.loaded) > keyLogMaxAge {
+			delete(k.secrets, key)
+		}
+	}
+	for random, givenUp := range k.missing {
+		if now.Sub(givenUp) > keyLogMaxAge {
+			delete(k.missing, random)
+		}
+	}
+}
+
+// load the lines appended to the file since the last load
+func (k *keyLog) load() {
+	k.evict()
+	file, err := os.Open(k.path)
+	if err != nil {
+		aggregated.Warn("open TLS key log failed: %v", core.LimitedError(err))
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		aggregated.Warn("stat TLS key log failed: %v", core.LimitedError(err))
+		return
+	}
+	// the file was truncated, or replaced
+	if info.Size() < k.offset {
+		k.offset = 0
+	}
+
+	_, err = file.Seek(k.offset, 0)
+	if err != nil {
+		aggregated.Warn("seek TLS key log failed: %v", core.LimitedError(err))
+		return
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		// a partially written line is read again on the next load
+		if err != nil {
+			break
+		}
+		k.offset += int64(len(line))
+		k.parseLine(strings.TrimSpace(line))
+	}
+}
+
+func (k *keyLog) parseLine(line string) {
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+
+	sections := strings.Fields(line)
+	if len(sections) != 3 {
+		aggregated.Warn("invalid TLS key log line")
+		return
+	}
+
+	clientRandom, err := hex.DecodeString(sections[1])
+	if err != nil {
+		aggregated.Warn("parse TLS key log client random failed: %v", core.LimitedError(err))
+		return
+	}
+	secret, err := hex.DecodeString(sections[2])
+	if err != nil {
+		aggregated.Warn("parse TLS key log secret failed: %v", core.LimitedError(err))
+		return
+	}
+	k.secrets[sections[0]+" "+hex.EncodeToString(clientRandom)] = keyLogSecret{value: secret, loaded: time.Now()}
+}
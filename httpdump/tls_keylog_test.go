@@ -0,0 +1,78 @@
+package httpdump
+
+import (
+	"bytes"
+	"github.com/alonana/httshark/core"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func writeKeyLog(t *testing.T, content string) string {
+	file, err := ioutil.TempFile("", "keylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = file.WriteString(content)
+	_ = file.Close()
+	return file.Name()
+}
+
+func TestKeyLogMissingSecret(t *testing.T) {
+	path := writeKeyLog(t, "CLIENT_RANDOM 0102 0a0b\n")
+	defer os.Remove(path)
+	k := newKeyLog(path)
+
+	if secret := k.secret(keyLogMasterSecret, []byte{1, 2}); !bytes.Equal(secret, []byte{0x0a, 0x0b}) {
+		t.Fatalf("wrong secret %x", secret)
+	}
+
+	start := time.Now()
+	if secret := k.secret(keyLogClientTrafficSecret, []byte{3, 4}); secret != nil {
+		t.Fatalf("unexpected secret %x", secret)
+	}
+	if time.Since(start) < keyLogWaitTimeout {
+		t.Fatal("a missing secret should be waited for")
+	}
+
+	// the client random was given up on, so the other direction does not wait for it again
+	start = time.Now()
+	if secret := k.secret(keyLogServerTrafficSecret, []byte{3, 4}); secret != nil {
+		t.Fatalf("unexpected secret %x", secret)
+	}
+	if time.Since(start) >= keyLogWaitInterval {
+		t.Fatalf("a given up client random was waited for %v", time.Since(start))
+	}
+}
+
+func TestKeyLogEviction(t *testing.T) {
+	path := writeKeyLog(t, "CLIENT_RANDOM 0102 0a0b\nCLIENT_RANDOM 0304 0c0d\n")
+	defer os.Remove(path)
+	k := newKeyLog(path)
+	k.load()
+
+	old := time.Now().Add(-2 * keyLogMaxAge)
+	secret := k.secrets[keyLogMasterSecret+" 0102"]
+	secret.loaded = old
+	k.secrets[keyLogMasterSecret+" 0102"] = secret
+	k.missing["0506"] = old
+	k.missing["0708"] = time.Now()
+
+	core.Config.PcapFile = "test.pcap"
+	k.evict()
+	if len(k.secrets) != 2 || len(k.missing) != 2 {
+		t.Fatalf("the secrets of a pcap file should be kept %+v %+v", k.secrets, k.missing)
+	}
+
+	// the eviction is throttled, and the load already ran it
+	core.Config.PcapFile = ""
+	k.lastEvict = time.Time{}
+	k.evict()
+	if _, exists := k.secrets[keyLogMasterSecret+" 0304"]; len(k.secrets) != 1 || !exists {
+		t.Fatalf("wrong secrets after eviction %+v", k.secrets)
+	}
+	if _, exists := k.missing["0708"]; len(k.missing) != 1 || !exists {
+		t.Fatalf("wrong missing client randoms after eviction %+v", k.missing)
+	}
+}
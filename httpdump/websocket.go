@@ -0,0 +1,310 @@
+package httpdump
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/alonana/httshark/core"
+	"github.com/alonana/httshark/core/aggregated"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const webSocketContinuation = 0
+const webSocketText = 1
+const webSocketBinary = 2
+const webSocketControl = 8
+
+// frames and inflated messages above this size are skipped
+const webSocketMaxMessageLength = 16 * 1024 * 1024
+
+// permessage-deflate messages are compressed using sync flush, without its tail, see RFC 7692
+var webSocketDeflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+const deflateWindowSize = 32 * 1024
+
+// if the response switches the connection to WebSocket
+func isWebSocketUpgrade(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusSwitchingProtocols && strings.EqualFold(resp.Header.Get("Upgrade"), "websocket")
+}
+
+// webSocketSession collects the messages of both directions
+type webSocketSession struct {
+	mutex         sync.Mutex
+	messages      []core.HttpWebSocketMessage
+	payloadBudget int
+	limited       bool
+}
+
+// webSocketDirection decodes the frames of one direction
+type webSocketDirection struct {
+	session         *webSocketSession
+	client          bool
+	deflate         bool
+	contextTakeover bool
+	window          []byte // the last inflated bytes, used as the dictionary of the next message
+	contextLost     bool   // a compressed message was skipped, so the window cannot be rebuilt
+
+	fragmented bool
+	opcode     int
+	compressed bool
+	started    time.Time
+	message    bytes.Buffer
+}
+
+// handleWebSocket decodes the WebSocket frames of both directions until the connection ends,
+// and reports the upgrade transaction with the session messages
+func (h *HTTPTrafficHandler) handleWebSocket(requestReader *streamClock, responseReader *streamClock, req *http.Request, resp *http.Response,
+	times transactionTimes, headers wireHeaders) {
+	core.V2("%v websocket traffic - starting", h.originalKey)
+	transaction := h.createTransaction(req, resp, times, headers)
+
+	deflate, clientTakeover, serverTakeover := parsePermessageDeflate(resp.Header)
+	session := &webSocketSession{payloadBudget: core.Config.WebSocketMaxPayload}
+	client := &webSocketDirection{session: session, client: true, deflate: deflate, contextTakeover: clientTakeover}
+	server := &webSocketDirection{session: session, deflate: deflate, contextTakeover: serverTakeover}
+
+	var serverFrames sync.WaitGroup
+	serverFrames.Add(1)
+	go func() {
+		defer serverFrames.Done()
+		server.readFrames(responseReader)
+	}()
+	client.readFrames(requestReader)
+	serverFrames.Wait()
+
+	core.V2("%v websocket traffic - terminating with %v messages", h.originalKey, len(session.messages))
+	if transaction == nil {
+		return
+	}
+	sort.SliceStable(session.messages, func(i, j int) bool {
+		return session.messages[i].Time.Before(session.messages[j].Time)
+	})
+	transaction.WebSocketMessages = session.messages
+	processor(*transaction)
+}
+
+// parsePermessageDeflate returns whether the permessage-deflate extension was accepted by the server,
+// and whether the client and the server keep the compression context between messages
+func parsePermessageDeflate(header http.Header) (bool, bool, bool) {
+	for _, extensions := range header["Sec-Websocket-Extensions"] {
+		for _, extension := range strings.Split(extensions, ",") {
+			params := strings.Split(extension, ";")
+			if strings.TrimSpace(params[0]) != "permessage-deflate" {
+				continue
+			}
+			clientTakeover := true
+			serverTakeover := true
+			for _, param := range params[1:] {
+				switch strings.TrimSpace(param) {
+				case "client_no_context_takeover":
+					clientTakeover = false
+				case "server_no_context_takeover":
+					serverTakeover = false
+				}
+			}
+			return true, clientTakeover, serverTakeover
+		}
+	}
+	return false, false, false
+}
+
+func (d *webSocketDirection) readFrames(reader *streamClock) {
+	header := make([]byte, 2)
+	for {
+		start := reader.position()
+		_, err := io.ReadFull(reader, header)
+		if err != nil {
+			return
+		}
+		timestamp := reader.timeAt(start)
+		final := header[0]&0x80 != 0
+		compressed := header[0]&0x40 != 0
+		opcode := int(header[0] & 0x0F)
+		masked := header[1]&0x80 != 0
+
+		length, err := readWebSocketLength(reader, header[1]&0x7F)
+		if err != nil {
+			return
+		}
+		var mask [4]byte
+		if masked {
+			_, err = io.ReadFull(reader, mask[:])
+			if err != nil {
+				return
+			}
+		}
+
+		if length > webSocketMaxMessageLength {
+			aggregated.Warn("skipping WebSocket frame of %v bytes", length)
+			_, err = io.CopyN(ioutil.Discard, reader, int64(length))
+			if err != nil {
+				return
+			}
+			if opcode == webSocketContinuation {
+				compressed = d.fragmented && d.compressed
+			}
+			d.skipMessage(compressed)
+			continue
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(reader, payload)
+		if err != nil {
+			return
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+		}
+
+		d.onFrame(final, compressed, opcode, payload, timestamp)
+	}
+}
+
+func readWebSocketLength(reader io.Reader, length byte) (uint64, error) {
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		_, err := io.ReadFull(reader, extended)
+		return uint64(binary.BigEndian.Uint16(extended)), err
+	case 127:
+		extended := make([]byte, 8)
+		_, err := io.ReadFull(reader, extended)
+		return binary.BigEndian.Uint64(extended), err
+	}
+	return uint64(length), nil
+}
+
+func (d *webSocketDirection) onFrame(final bool, compressed bool, opcode int, payload []byte, timestamp time.Time) {
+	// control frames might be sent between the fragments of a message
+	if opcode >= webSocketControl {
+		d.session.add(d.client, opcode, payload, timestamp)
+		return
+	}
+
+	if opcode == webSocketContinuation {
+		if !d.fragmented {
+			aggregated.Warn("WebSocket continuation frame without a message start")
+			return
+		}
+	} else {
+		d.fragmented = true
+		d.opcode = opcode
+		d.compressed = compressed
+		d.started = timestamp
+		d.message.Reset()
+	}
+
+	d.message.Write(payload)
+	if d.message.Len() > webSocketMaxMessageLength {
+		aggregated.Warn("skipping WebSocket message above %v bytes", webSocketMaxMessageLength)
+		d.skipMessage(d.compressed)
+		return
+	}
+	if !final {
+		return
+	}
+
+	d.fragmented = false
+	message := d.message.Bytes()
+	if d.compressed && d.deflate {
+		if d.contextLost {
+			core.V2("skipping a compressed WebSocket message, as the compression context was lost")
+			return
+		}
+		inflated, err := d.inflate(message)
+		if err != nil {
+			aggregated.Warn("inflate WebSocket message failed: %v", core.LimitedError(err))
+			d.skipMessage(true)
+			return
+		}
+		message = inflated
+	}
+	d.session.add(d.client, d.opcode, message, d.started)
+}
+
+// skipMessage drops the current message.
+// When the compression context is kept between messages, the next messages are compressed using the skipped one,
+// so once a compressed message is skipped the next compressed messages of the direction are skipped too.
+func (d *webSocketDirection) skipMessage(compressed bool) {
+	d.fragmented = false
+	if !compressed || !d.deflate || !d.contextTakeover || d.contextLost {
+		return
+	}
+	d.contextLost = true
+	aggregated.Warn("WebSocket compressed message skipped, the next compressed messages of the connection are not inflated")
+}
+
+func (d *webSocketDirection) inflate(compressed []byte) ([]byte, error) {
+	var dictionary []byte
+	if d.contextTakeover {
+		dictionary = d.window
+	}
+	input := io.MultiReader(bytes.NewReader(compressed), bytes.NewReader(webSocketDeflateTail))
+	reader := flate.NewReaderDict(input, dictionary)
+	// the sync flush is not the final block, so the reader reports an unexpected EOF once the input is consumed
+	data, err := ioutil.ReadAll(io.LimitReader(reader, webSocketMaxMessageLength+1))
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if len(data) > webSocketMaxMessageLength {
+		return nil, fmt.Errorf("inflated message is above %v bytes", webSocketMaxMessageLength)
+	}
+
+	if d.contextTakeover {
+		d.window = append(d.window, data...)
+		if len(d.window) > deflateWindowSize {
+			d.window = append([]byte(nil), d.window[len(d.window)-deflateWindowSize:]...)
+		}
+	}
+	return data, nil
+}
+
+// add a message, while retaining the payloads up to the session payload budget
+func (s *webSocketSession) add(client bool, opcode int, payload []byte, timestamp time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(payload) > s.payloadBudget {
+		if !s.limited && core.Config.WebSocketMaxPayload > 0 {
+			aggregated.Warn("WebSocket session payload limit reached, the next messages payload is not retained")
+		}
+		s.limited = true
+		cut := s.payloadBudget
+		// a text payload is cut at a character boundary
+		if opcode == webSocketText {
+			for cut > 0 && !utf8.RuneStart(payload[cut]) {
+				cut--
+			}
+		}
+		payload = payload[:cut]
+	}
+	s.payloadBudget -= len(payload)
+
+	messageType := "receive"
+	if client {
+		messageType = "send"
+	}
+	s.messages = append(s.messages, core.HttpWebSocketMessage{
+		Type:   messageType,
+		Time:   timestamp,
+		Opcode: opcode,
+		Data:   encodeWebSocketPayload(opcode, payload),
+	})
+}
+
+func encodeWebSocketPayload(opcode int, payload []byte) string {
+	if opcode == webSocketBinary || !utf8.Valid(payload) {
+		return base64.StdEncoding.EncodeToString(payload)
+	}
+	return string(payload)
+}
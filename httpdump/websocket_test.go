@@ -0,0 +1,172 @@
+package httpdump
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"github.com/alonana/httshark/core"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func webSocketFrame(final bool, compressed bool, opcode int, mask []byte, payload []byte) []byte {
+	var frame bytes.Buffer
+	first := byte(opcode)
+	if final {
+		first |= 0x80
+	}
+	if compressed {
+		first |= 0x40
+	}
+	frame.WriteByte(first)
+
+	second := byte(0)
+	if mask != nil {
+		second = 0x80
+	}
+	if len(payload) < 126 {
+		frame.WriteByte(second | byte(len(payload)))
+	} else {
+		frame.WriteByte(second | 126)
+		frame.Write([]byte{byte(len(payload) >> 8), byte(len(payload))})
+	}
+
+	if mask != nil {
+		frame.Write(mask)
+		masked := make([]byte, len(payload))
+		for i := range payload {
+			masked[i] = payload[i] ^ mask[i%4]
+		}
+		payload = masked
+	}
+	frame.Write(payload)
+	return frame.Bytes()
+}
+
+// deflateMessages compresses the messages using a shared context, as done by permessage-deflate with context takeover
+func deflateMessages(t *testing.T, messages ...string) [][]byte {
+	var buffer bytes.Buffer
+	writer, err := flate.NewWriter(&buffer, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compressed [][]byte
+	for _, message := range messages {
+		buffer.Reset()
+		_, _ = writer.Write([]byte(message))
+		_ = writer.Flush()
+		data := buffer.Bytes()
+		compressed = append(compressed, append([]byte(nil), data[:len(data)-len(webSocketDeflateTail)]...))
+	}
+	return compressed
+}
+
+func runWebSocket(t *testing.T, extensions string, client []byte, server []byte) core.HttpTransaction {
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(
+		"GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"
+	if extensions != "" {
+		response += "Sec-WebSocket-Extensions: " + extensions + "\r\n"
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(response+"\r\n")), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transactions := collectTransactions(t, func() {
+		h := &HTTPTrafficHandler{originalKey: "test"}
+		h.handleWebSocket(newStreamClock(untimed(bytes.NewReader(client))), newStreamClock(untimed(bytes.NewReader(server))), req, resp, transactionTimes{}, wireHeaders{})
+	})
+	if len(transactions) != 1 {
+		t.Fatalf("expected 1 transaction, but got %+v", transactions)
+	}
+	if transactions[0].Response == nil || transactions[0].Response.Code != http.StatusSwitchingProtocols {
+		t.Fatalf("wrong upgrade transaction %+v", transactions[0])
+	}
+	return transactions[0]
+}
+
+func TestWebSocketMessages(t *testing.T) {
+	core.Config.WebSocketMaxPayload = 1024
+	mask := []byte{1, 2, 3, 4}
+	var client []byte
+	client = append(client, webSocketFrame(false, false, 1, mask, []byte("hello "))...)
+	client = append(client, webSocketFrame(true, false, 9, mask, []byte("ping"))...)
+	client = append(client, webSocketFrame(true, false, 0, mask, []byte("world"))...)
+
+	compressed := deflateMessages(t, "repeated message", "repeated message")
+	var server []byte
+	server = append(server, webSocketFrame(true, true, 1, nil, compressed[0])...)
+	server = append(server, webSocketFrame(true, true, 1, nil, compressed[1])...)
+	server = append(server, webSocketFrame(true, false, 2, nil, []byte{0xff, 0x00})...)
+
+	transaction := runWebSocket(t, "permessage-deflate; client_max_window_bits", client, server)
+
+	var sent, received []core.HttpWebSocketMessage
+	for _, message := range transaction.WebSocketMessages {
+		if message.Type == "send" {
+			sent = append(sent, message)
+		} else {
+			received = append(received, message)
+		}
+	}
+	if len(sent) != 2 || sent[0].Opcode != 9 || sent[0].Data != "ping" || sent[1].Opcode != 1 || sent[1].Data != "hello world" {
+		t.Fatalf("wrong sent messages %+v", sent)
+	}
+	if len(received) != 3 || received[0].Data != "repeated message" || received[1].Data != "repeated message" ||
+		received[2].Opcode != 2 || received[2].Data != "/wA=" {
+		t.Fatalf("wrong received messages %+v", received)
+	}
+}
+
+func TestWebSocketPayloadLimit(t *testing.T) {
+	core.Config.WebSocketMaxPayload = 8
+	defer func() { core.Config.WebSocketMaxPayload = 1024 }()
+
+	var server []byte
+	server = append(server, webSocketFrame(true, false, 1, nil, []byte("12345"))...)
+	server = append(server, webSocketFrame(true, false, 1, nil, []byte("67890"))...)
+	server = append(server, webSocketFrame(true, false, 1, nil, []byte("abc"))...)
+
+	transaction := runWebSocket(t, "", nil, server)
+	messages := transaction.WebSocketMessages
+	if len(messages) != 3 || messages[0].Data != "12345" || messages[1].Data != "678" || messages[2].Data != "" {
+		t.Fatalf("wrong limited messages %+v", messages)
+	}
+}
+
+func TestWebSocketTextPayloadLimit(t *testing.T) {
+	core.Config.WebSocketMaxPayload = 8
+	defer func() { core.Config.WebSocketMaxPayload = 1024 }()
+
+	var server []byte
+	server = append(server, webSocketFrame(true, false, 1, nil, []byte("12345"))...)
+	server = append(server, webSocketFrame(true, false, 1, nil, []byte("67é"))...)
+	server = append(server, webSocketFrame(true, false, 1, nil, []byte("abc"))...)
+
+	transaction := runWebSocket(t, "", nil, server)
+	messages := transaction.WebSocketMessages
+	if len(messages) != 3 || messages[0].Data != "12345" || messages[1].Data != "67" || messages[2].Data != "a" {
+		t.Fatalf("wrong limited messages %+v", messages)
+	}
+}
+
+func TestWebSocketSkippedCompressedMessage(t *testing.T) {
+	core.Config.WebSocketMaxPayload = 1024
+	compressed := deflateMessages(t, "repeated message", strings.Repeat("a", webSocketMaxMessageLength+1), "repeated message")
+	var server []byte
+	for _, message := range compressed {
+		server = append(server, webSocketFrame(true, true, 1, nil, message)...)
+	}
+	server = append(server, webSocketFrame(true, false, 1, nil, []byte("plain"))...)
+
+	transaction := runWebSocket(t, "permessage-deflate", nil, server)
+	messages := transaction.WebSocketMessages
+	if len(messages) != 2 || messages[0].Data != "repeated message" || messages[1].Data != "plain" {
+		t.Fatalf("wrong messages after a skipped compressed message %+v", messages)
+	}
+}
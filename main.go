@@ -1,8 +1,14 @@
 package main
 
-import "github.com/alonana/httshark/server"
+import (
+	"github.com/alonana/httshark/server"
+	"os"
+)
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(server.Validate(os.Args[2:]))
+	}
 	e := server.EntryPoint{}
 	e.Run()
 }
@@ -7,29 +7,23 @@ import (
 	"github.com/alonana/httshark/core/aggregated"
 	"github.com/alonana/httshark/core/log"
 	"github.com/alonana/httshark/exporters"
-	"github.com/alonana/httshark/httpdump"
+	_ "github.com/alonana/httshark/httpdump"
 	"github.com/alonana/httshark/tshark"
-	"github.com/alonana/httshark/tshark/bulk"
-	"github.com/alonana/httshark/tshark/correlator"
-	"github.com/alonana/httshark/tshark/line"
 	"github.com/sirupsen/logrus"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"runtime"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
 )
 
 type EntryPoint struct {
-	signalsChannel      chan os.Signal
-	correlatorProcessor correlator.Processor
-	bulkProcessor       bulk.Processor
-	lineProcessor       line.Processor
-	exporterProcessor   *exporters.Processor
+	signalsChannel    chan os.Signal
+	captureEngine     core.CaptureEngine
+	exporterProcessor *exporters.Processor
 }
 
 func IAmAlive(duration time.Duration, logger *logrus.Logger) {
@@ -74,40 +68,98 @@ func (p *EntryPoint) Run() {
 
 	p.exporterProcessor = exporters.CreateProcessor(logger)
 	p.exporterProcessor.Start()
+	go reportExporterDrops(logger, p.exporterProcessor)
 
-	if core.Config.Capture == "httpdump" {
-		httpdump.RunHttpDump(p.exporterProcessor.Queue)
-	} else {
-		p.correlatorProcessor = correlator.Processor{Processor: p.exporterProcessor.Queue, Logger: logger}
-		p.correlatorProcessor.Start()
+	captureEngine, err := core.CreateCaptureEngine(core.Config.Capture, logger)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("create capture engine failed: %v", err))
+	}
+	p.captureEngine = captureEngine
+	err = p.captureEngine.Start(p.exporterProcessor.Queue)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("start %v capture engine failed: %v", core.Config.Capture, err))
+	}
 
-		p.bulkProcessor = bulk.Processor{HttpProcessor: p.correlatorProcessor.Queue, Logger: logger}
-		p.bulkProcessor.Start()
+	// a pcap file has no drop counters
+	if core.Config.PcapFile == "" {
+		go reportCaptureStats(logger, p.captureEngine)
+	}
 
-		p.lineProcessor = line.Processor{BulkProcessor: p.bulkProcessor.Queue, Logger: logger}
-		p.lineProcessor.Start()
+	p.signalsChannel = make(chan os.Signal, 1)
+	signal.Notify(p.signalsChannel, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
+	select {
+	case <-p.signalsChannel:
+		logger.Info(fmt.Sprintf("Termination initiated. PID: %v",os.Getpid()))
+	case <-p.captureEngine.Done():
+		if core.Config.PcapFile != "" {
+			logger.Info(fmt.Sprintf("pcap file %v processing complete", core.Config.PcapFile))
+		} else {
+			logger.Info("capture ended")
+		}
+	}
+
+	p.shutdown(logger)
+}
 
-		t := tshark.CommandLine{
-			Processor: p.lineProcessor.Queue,
-			Logger: logger,
+// shutdown stops the capture first, so the in progress connections and requests are flushed as transactions,
+// and then stops the exporter, so the held transactions are exported and the har processors are closed.
+// A stage that does not complete within the shutdown timeout is abandoned, and the data it holds is lost.
+func (p *EntryPoint) shutdown(logger *logrus.Logger) {
+	start := time.Now()
+	deadline := start.Add(core.Config.ShutdownTimeout)
+	var flushed []string
+	var lost []string
+
+	var captureFlush core.FlushStats
+	if runUntil(deadline, func() { captureFlush = p.captureEngine.Stop() }) {
+		flushed = append(flushed, fmt.Sprintf("%v in progress connections, %v requests without response",
+			captureFlush.Connections, captureFlush.Requests))
+	} else {
+		logger.Warn(fmt.Sprintf("capture engine stop did not complete within %v", core.Config.ShutdownTimeout))
+		lost = append(lost, "the in progress transactions of the capture engine")
+	}
+
+	var summary exporters.StopSummary
+	if runUntil(deadline, func() { summary = p.exporterProcessor.Stop() }) {
+		flushed = append(flushed, fmt.Sprintf("%v exporter transactions", summary.Flushed))
+		if summary.Drops.DroppedNewest+summary.Drops.DroppedOldest > 0 {
+			lost = append(lost, fmt.Sprintf("%v transactions dropped by the exporter limits",
+				summary.Drops.DroppedNewest+summary.Drops.DroppedOldest))
 		}
-		err := t.Start()
-		if err != nil {
-			logger.Fatal(fmt.Sprintf("start command failed: %v", err))
+		if len(summary.FailedClosers) > 0 {
+			lost = append(lost, fmt.Sprintf("the data of the %v har processors", strings.Join(summary.FailedClosers, ",")))
 		}
+	} else {
+		logger.Warn(fmt.Sprintf("exporter stop did not complete within %v", core.Config.ShutdownTimeout))
+		lost = append(lost, "the transactions held by the exporter")
 	}
-	p.signalsChannel = make(chan os.Signal, 1)
-	signal.Notify(p.signalsChannel, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
-	<-p.signalsChannel
 
-	logger.Info(fmt.Sprintf("Termination initiated. PID: %v",os.Getpid()))
-	if core.Config.Capture == "tshark" {
-		p.lineProcessor.Stop()
-		p.bulkProcessor.Stop()
-		p.correlatorProcessor.Stop()
+	if len(flushed) == 0 {
+		flushed = append(flushed, "nothing")
+	}
+	if len(lost) == 0 {
+		lost = append(lost, "nothing")
+	}
+	logger.Info(fmt.Sprintf("Terminating complete in %v. flushed: %v. lost: %v",
+		time.Since(start), strings.Join(flushed, ", "), strings.Join(lost, ", ")))
+}
+
+// runUntil runs the stage, and returns false if it does not complete until the deadline
+func runUntil(deadline time.Time, stage func()) bool {
+	done := make(chan bool)
+	go func() {
+		stage()
+		close(done)
+	}()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
 	}
-	p.exporterProcessor.Stop()
-	logger.Info(fmt.Sprintf("Terminating complete"))
 }
 
 
@@ -122,18 +174,6 @@ func (p *EntryPoint) health(w http.ResponseWriter, _ *http.Request) {
 	_, _ = w.Write([]byte(err.Error()))
 }
 
-//dumpcapDropPacketReport example:
-//Packets received/dropped on interface 'eno2': 7467018/3189 (pcap:3189/dumpcap:0/flushed:0/ps_ifdrop:0) (100.0%)
-func getPacketDropStats(dumpcapDropPacketReport string) (received float64, dropped float64) {
-	leftIdx := strings.Index(dumpcapDropPacketReport,":") + 1
-	rightIdx := strings.Index(dumpcapDropPacketReport,"(")
-	temp:= strings.TrimSpace(dumpcapDropPacketReport[leftIdx:rightIdx])
-	slashIdx := strings.Index(temp,"/")
-	received, _ = strconv.ParseFloat(temp[0:slashIdx], 64)
-	dropped, _ = strconv.ParseFloat(temp[slashIdx+1:], 64)
-	return received,dropped
-}
-
 func reportDroppedPackets(logger *logrus.Logger) {
 	if fileExists(core.PacketDropFileName){
 		lines,err := readLines(core.PacketDropFileName)
@@ -147,21 +187,103 @@ func reportDroppedPackets(logger *logrus.Logger) {
 			return
 		}
 		dumpcapReport := lastLine[pipeIdx:]
-		received,dropped := getPacketDropStats(dumpcapReport)
-		errCnt := 0
-		err = core.CloudWatchClient.PutMetric(fmt.Sprintf("%v_received_packets", core.Config.DCVAName), "Count", received, core.NAMESPACE)
-		if err != nil {
-			logger.Error(fmt.Sprintf("Failed to put packet stats (received) in CW: %v",err))
-			errCnt++
+		stats := tshark.ParsePacketDropReport(dumpcapReport)
+		putPacketsMetrics(logger, stats)
+	}
+}
+
+// reportCaptureStats publishes the capture engine packets counters of each interval to CloudWatch and to the log,
+// until the capture engine is done.
+// Notice that dumpcap reports its counters only when it terminates, so the tshark counters are mostly empty.
+// Nothing is published while the engine has no counters, as the same metrics are published by reportDroppedPackets.
+func reportCaptureStats(logger *logrus.Logger, captureEngine core.CaptureEngine) {
+	last := make(map[string]core.CaptureStats)
+	ticker := time.NewTicker(core.Config.CloudWatchStatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-captureEngine.Done():
+			return
+		case <-ticker.C:
+			interfacesStats := captureEngine.Stats()
+			if len(interfacesStats) == 0 {
+				continue
+			}
+			var total core.CaptureStats
+			for _, stats := range interfacesStats {
+				delta := stats.Sub(last[stats.Interface])
+				last[stats.Interface] = stats
+				total = total.Add(delta)
+				logger.Info(fmt.Sprintf("interface %v interval stats: captured %v, received %v, dropped %v, interface dropped %v, queue freezes %v",
+					stats.Interface, delta.Captured, delta.Received, delta.Dropped, delta.IfDropped, delta.Freezes))
+			}
+			putPacketsMetrics(logger, total)
+			warnOnDrops(logger, total)
 		}
-		err = core.CloudWatchClient.PutMetric(fmt.Sprintf("%v_dropped_packets",core.Config.DCVAName),"Count",dropped,core.NAMESPACE)
+	}
+}
+
+// warnOnDrops warns when the percent of the dropped packets in the interval is above the drop-warning-percent
+func warnOnDrops(logger *logrus.Logger, stats core.CaptureStats) {
+	dropPercent := stats.DropPercent()
+	if core.Config.DropWarningPercent == 0 || dropPercent <= core.Config.DropWarningPercent {
+		return
+	}
+	logger.Warn(fmt.Sprintf("capture dropped %.2f%% of the packets in the last %v (received: %v, dropped: %v, interface dropped: %v)",
+		dropPercent, core.Config.CloudWatchStatsInterval, stats.Received, stats.Dropped, stats.IfDropped))
+}
+
+// reportExporterDrops publishes the exporter overflow policy decisions of each interval to CloudWatch
+func reportExporterDrops(logger *logrus.Logger, processor *exporters.Processor) {
+	var last exporters.DropCounters
+	ticker := time.NewTicker(core.Config.CloudWatchStatsInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		drops := processor.DropCounters()
+		metrics := map[string]uint64{
+			"exporter_dropped_newest": drops.DroppedNewest - last.DroppedNewest,
+			"exporter_dropped_oldest": drops.DroppedOldest - last.DroppedOldest,
+			"exporter_dropped_bodies": drops.DroppedBodies - last.DroppedBodies,
+			"exporter_blocked":        drops.Blocked - last.Blocked,
+		}
+		last = drops
+		for name, value := range metrics {
+			err := core.CloudWatchClient.PutMetric(fmt.Sprintf("%v_%v", core.Config.DCVAName, name), "Count", float64(value), core.NAMESPACE)
+			if err != nil {
+				logger.Error(fmt.Sprintf("Failed to put exporter stats (%v) in CW: %v", name, err))
+			}
+		}
+	}
+}
+
+func putPacketsMetrics(logger *logrus.Logger, stats core.CaptureStats) {
+	received := float64(stats.Received)
+	dropped := float64(stats.Dropped)
+	errCnt := 0
+	err := core.CloudWatchClient.PutMetric(fmt.Sprintf("%v_received_packets", core.Config.DCVAName), "Count", received, core.NAMESPACE)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to put packet stats (received) in CW: %v", err))
+		errCnt++
+	}
+	err = core.CloudWatchClient.PutMetric(fmt.Sprintf("%v_dropped_packets", core.Config.DCVAName), "Count", dropped, core.NAMESPACE)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to put packet stats (dropped) in CW: %v", err))
+		errCnt++
+	}
+	err = core.CloudWatchClient.PutMetric(fmt.Sprintf("%v_if_dropped_packets", core.Config.DCVAName), "Count", float64(stats.IfDropped), core.NAMESPACE)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to put packet stats (interface dropped) in CW: %v", err))
+		errCnt++
+	}
+	if core.Config.Capture == "afpacket" {
+		err = core.CloudWatchClient.PutMetric(fmt.Sprintf("%v_queue_freezes", core.Config.DCVAName), "Count", float64(stats.Freezes), core.NAMESPACE)
 		if err != nil {
-			logger.Error(fmt.Sprintf("Failed to put packet stats (dropped) in CW: %v",err))
+			logger.Error(fmt.Sprintf("Failed to put packet stats (queue freezes) in CW: %v", err))
 			errCnt++
 		}
-		if errCnt == 0 {
-			logger.Info(fmt.Sprintf("Packet metric stats was sent to CloudWatch. received: %v, dropped: %v",received,dropped))
-		}
+	}
+	if errCnt == 0 {
+		logger.Info(fmt.Sprintf("Packet metric stats was sent to CloudWatch. received: %v, dropped: %v, interface dropped: %v, queue freezes: %v", received, dropped, stats.IfDropped, stats.Freezes))
 	}
 }
 
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"fmt"
+	"github.com/alonana/httshark/har"
+	"io/ioutil"
+	"os"
+)
+
+// Validate runs the validate command, which reports the HAR 1.2 spec violations of the HAR files.
+// It returns the process exit code, which is 1 if any file is invalid.
+func Validate(files []string) int {
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: httshark validate <file.har>...")
+		return 2
+	}
+
+	exitCode := 0
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "read %v failed: %v\n", file, err)
+			exitCode = 1
+			continue
+		}
+		violations, err := har.Validate(data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", file, err)
+			exitCode = 1
+			continue
+		}
+		for _, violation := range violations {
+			fmt.Printf("%v: %v\n", file, violation)
+		}
+		if len(violations) > 0 {
+			exitCode = 1
+			continue
+		}
+		fmt.Printf("%v: valid HAR 1.2\n", file)
+	}
+	return exitCode
+}
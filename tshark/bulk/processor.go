@@ -45,17 +45,14 @@ func (p *Processor) parseJson() {
 	for !p.stopped {
 		select {
 		case data := <-p.json:
-			var entry types.Stdout
-			err := json.Unmarshal([]byte(data), &entry)
-			if err == nil {
-				p.convert(&entry, data)
-			} else {
-				p.Logger.Warn(fmt.Sprintf("parse tshark stdout JSON %v failed:%v", data, err))
-			}
+			p.parseSingle(data)
 			break
 
 		case <-p.stopChannel:
 			core.V1("bulk processor stopping")
+			for len(p.json) > 0 {
+				p.parseSingle(<-p.json)
+			}
 			p.stopped = true
 			break
 		}
@@ -64,6 +61,16 @@ func (p *Processor) parseJson() {
 	p.waitGroup.Done()
 }
 
+func (p *Processor) parseSingle(data string) {
+	var entry types.Stdout
+	err := json.Unmarshal([]byte(data), &entry)
+	if err == nil {
+		p.convert(&entry, data)
+	} else {
+		p.Logger.Warn(fmt.Sprintf("parse tshark stdout JSON %v failed:%v", data, err))
+	}
+}
+
 func (p *Processor) convert(tsharkJson *types.Stdout, originalEntry string) {
 	core.V5("json entry is %+v", tsharkJson)
 	layers := tsharkJson.Source.Layers
@@ -85,83 +92,220 @@ func (p *Processor) convert(tsharkJson *types.Stdout, originalEntry string) {
 		return
 	}
 
-	data := ""
-	if len(layers.Data) > 0 {
-		data = layers.Data[0]
-	}
-
 	httpEntry := core.HttpEntry{
 		Time:   entryTime,
 		Stream: stream,
-		Data:   data,
+		Frame:  p.getFrame(firstOf(layers.FrameNumber)),
 	}
 
+	// a frame might hold several pipelined messages, which tshark reports as several values of each field
 	if len(layers.IsRequest) > 0 {
-		if len(layers.RequestVersion) > 0 {
-			httpEntry.Version = layers.RequestVersion[0]
-		}
-		httpEntry.Headers = layers.RequestLine
-
-		path := "/"
-		query := ""
-		if len(layers.RequestUri) > 0 {
-			requestUri := layers.RequestUri[0]
-			if strings.Contains(requestUri, "?") {
-				sections := strings.Split(requestUri, "?")
-				path = sections[0]
-				query = sections[1]
-			} else {
-				path = requestUri
-			}
-		}
-
-		method := ""
-		if len(layers.RequestMethod) > 0 {
-			method = layers.RequestMethod[0]
-		}
-		dstIp := layers.DstIp[0]
-		dstPort := layers.DstPort[0]
-		dstPortInt,err := strconv.Atoi(dstPort)
+		ipAndPort, err := p.getEndpoints(&layers)
 		if err != nil {
-			p.Logger.Warn(fmt.Sprintf("parse dst port in %+v failed: %v", tsharkJson, err))
+			p.Logger.Warn(fmt.Sprintf("parse endpoints in %+v failed: %v", tsharkJson, err))
 			return
 		}
-		ipAndPort := core.HttpIpAndPort{DstIP: dstIp, DstPort: dstPortInt}
-		//IpAndPort HttpIpAndPort
-		request := core.HttpRequest{
-			HttpIpAndPort: ipAndPort,
-			HttpEntry: httpEntry,
-			Method:    method,
-			Path:      path,
-			Query:     query,
+		ipAndPort.ConnectionID = strconv.Itoa(stream)
+		count := len(layers.IsRequest)
+		headers := splitHeaderLines(layers.RequestLine, count)
+		for i := 0; i < count; i++ {
+			p.HttpProcessor(p.createRequest(&layers, i, httpEntry, headers[i], ipAndPort))
 		}
-
-		p.HttpProcessor(request)
 	} else if len(layers.IsResponse) > 0 {
-		if len(layers.ResponseCode) == 0 {
-			p.Logger.Warn(fmt.Sprintf("missing response code in %+v", tsharkJson))
-			return
+		count := len(layers.IsResponse)
+		headers := splitHeaderLines(layers.ResponseLine, count)
+		for i := 0; i < count; i++ {
+			response, err := p.createResponse(&layers, i, httpEntry, headers[i])
+			if err != nil {
+				p.Logger.Warn(fmt.Sprintf("%v in %+v", err, tsharkJson))
+				continue
+			}
+			p.HttpProcessor(response)
 		}
+	} else {
+		core.V5("ignoring not request/response: %v", originalEntry)
+	}
+}
 
-		code, err := strconv.Atoi(layers.ResponseCode[0])
-		if err != nil {
-			p.Logger.Warn(fmt.Sprintf("parse response code in %+v failed: %v", tsharkJson, err))
-			return
+// createRequest returns the request at the index among the requests of the frame
+func (p *Processor) createRequest(layers *types.Layers, index int, httpEntry core.HttpEntry, headers []string,
+	ipAndPort core.HttpIpAndPort) core.HttpRequest {
+	count := len(layers.IsRequest)
+	httpEntry.Data = valueAt(layers.Data, index, count)
+	httpEntry.Version = valueAt(layers.RequestVersion, index, count)
+	httpEntry.Headers = headers
+	httpEntry.PairedFrame = p.getFrame(valueAt(layers.ResponseIn, index, count))
+	httpEntry.TruncateBody(core.Config.RequestBodyMaxSize)
+
+	// the full uri is missing when tshark cannot tell the host, and the exporter completes the url
+	path := "/"
+	query := ""
+	requestUri := valueAt(layers.RequestUri, index, count)
+	if requestUri == "" {
+		requestUri = valueAt(layers.RequestPath, index, count)
+	}
+	if requestUri != "" {
+		if strings.Contains(requestUri, "?") {
+			sections := strings.SplitN(requestUri, "?", 2)
+			path = sections[0]
+			query = sections[1]
+		} else {
+			path = requestUri
 		}
+	}
+
+	return core.HttpRequest{
+		HttpIpAndPort: ipAndPort,
+		HttpEntry:     httpEntry,
+		Method:        valueAt(layers.RequestMethod, index, count),
+		Path:          path,
+		Query:         query,
+	}
+}
+
+// createResponse returns the response at the index among the responses of the frame
+func (p *Processor) createResponse(layers *types.Layers, index int, httpEntry core.HttpEntry, headers []string) (core.HttpResponse, error) {
+	count := len(layers.IsResponse)
+	codeValue := valueAt(layers.ResponseCode, index, count)
+	if codeValue == "" {
+		return core.HttpResponse{}, fmt.Errorf("missing response code %v", index)
+	}
+	code, err := strconv.Atoi(codeValue)
+	if err != nil {
+		return core.HttpResponse{}, fmt.Errorf("parse response code %v failed: %v", index, err)
+	}
 
-		if len(layers.ResponseVersion) > 0 {
-			httpEntry.Version = layers.ResponseVersion[0]
+	httpEntry.Data = valueAt(layers.Data, index, count)
+	httpEntry.Version = valueAt(layers.ResponseVersion, index, count)
+	httpEntry.Headers = headers
+	httpEntry.PairedFrame = p.getFrame(valueAt(layers.RequestIn, index, count))
+	httpEntry.TruncateBody(core.Config.ResponseBodyMaxSize)
+	return core.HttpResponse{
+		HttpEntry:  httpEntry,
+		Code:       code,
+		StatusText: valueAt(layers.ResponsePhrase, index, count),
+	}, nil
+}
+
+// valueAt returns the value of the message at the index, among the count messages of the frame.
+// tshark omits the fields that a message does not have, e.g. the body, so when the values do not match the messages
+// they cannot be attributed, except for a single message, which gets the first value.
+func valueAt(values []string, index int, count int) string {
+	if len(values) == count {
+		return values[index]
+	}
+	if count == 1 {
+		return firstOf(values)
+	}
+	return ""
+}
+
+func firstOf(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// splitHeaderLines returns the header lines of each of the count messages of the frame.
+// tshark reports the lines of all the messages together, so they are split before each repetition of the first header,
+// as the messages of a single sender list their headers in the same order.
+// In case the first header does not appear once in each message, all the lines are given to the first message.
+func splitHeaderLines(lines []string, count int) [][]string {
+	messages := make([][]string, count)
+	lines = trimHeaderLines(lines)
+	if count == 1 || len(lines) == 0 {
+		messages[0] = lines
+		return messages
+	}
+
+	boundary := headerName(lines[0])
+	var starts []int
+	for i, line := range lines {
+		if strings.EqualFold(headerName(line), boundary) {
+			starts = append(starts, i)
 		}
-		httpEntry.Headers = layers.ResponseLine
-		response := core.HttpResponse{
-			HttpEntry: httpEntry,
-			Code:      code,
+	}
+	if len(starts) != count {
+		core.V2("cannot split the header lines of %v messages by %v, keeping them in the first message", count, boundary)
+		messages[0] = lines
+		return messages
+	}
+	for i, start := range starts {
+		end := len(lines)
+		if i+1 < count {
+			end = starts[i+1]
 		}
+		messages[i] = lines[start:end]
+	}
+	return messages
+}
 
-		p.HttpProcessor(response)
-	} else {
-		core.V5("ignoring not request/response: %v", originalEntry)
+func headerName(line string) string {
+	position := strings.Index(line, ":")
+	if position == -1 {
+		return line
+	}
+	return strings.TrimSpace(line[:position])
+}
+
+// trimHeaderLines removes the line terminators that tshark keeps in the header lines
+func trimHeaderLines(lines []string) []string {
+	trimmed := make([]string, len(lines))
+	for i, line := range lines {
+		trimmed[i] = strings.TrimRight(line, "\r\n")
+	}
+	return trimmed
+}
+
+// getFrame returns the frame number, or 0 in case tshark did not report it
+func (p *Processor) getFrame(value string) int {
+	if value == "" {
+		return 0
+	}
+	frame, err := strconv.Atoi(value)
+	if err != nil {
+		p.Logger.Warn(fmt.Sprintf("parse frame number %v failed: %v", value, err))
+		return 0
+	}
+	return frame
+}
+
+// getEndpoints returns the IPv4 or IPv6 source and destination of the request.
+// An endpoint is empty in case tshark did not report it.
+func (p *Processor) getEndpoints(layers *types.Layers) (core.HttpIpAndPort, error) {
+	var ipAndPort core.HttpIpAndPort
+	ipAndPort.SrcIP = firstValue(layers.SrcIp, layers.SrcIpv6)
+	ipAndPort.DstIP = firstValue(layers.DstIp, layers.DstIpv6)
+
+	var err error
+	ipAndPort.SrcPort, err = parsePort(layers.SrcPort)
+	if err != nil {
+		return ipAndPort, fmt.Errorf("parse src port failed: %v", err)
+	}
+	ipAndPort.DstPort, err = parsePort(layers.DstPort)
+	if err != nil {
+		return ipAndPort, fmt.Errorf("parse dst port failed: %v", err)
+	}
+	return ipAndPort, nil
+}
+
+// firstValue returns the IPv4 value if reported, and otherwise the IPv6 value
+func firstValue(ipv4 []string, ipv6 []string) string {
+	if len(ipv4) > 0 {
+		return ipv4[0]
+	}
+	if len(ipv6) > 0 {
+		return ipv6[0]
+	}
+	return ""
+}
+
+func parsePort(values []string) (int, error) {
+	if len(values) == 0 {
+		return 0, nil
 	}
+	return strconv.Atoi(values[0])
 }
 
 func (p *Processor) parseTime(layers *types.Layers) (*time.Time, error) {
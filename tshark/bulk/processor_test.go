@@ -3,12 +3,14 @@ package bulk
 import (
 	"fmt"
 	"github.com/alonana/httshark/core"
+	"github.com/sirupsen/logrus"
 	"io/ioutil"
+	"strings"
 	"testing"
 )
 
 func TestEmpty(t *testing.T) {
-	p := Processor{}
+	p := Processor{Logger: logrus.New()}
 	p.Start()
 	p.Stop()
 }
@@ -19,23 +21,98 @@ func TestRequest(t *testing.T) {
 	if request.Method != "GET" {
 		t.Fatalf("wrong method %v", request.Method)
 	}
+	if len(request.Headers) != 3 || request.Headers[0] != "Host: example.com" || request.Headers[2] != "Accept: */*" {
+		t.Fatalf("wrong headers %q", request.Headers)
+	}
+	if request.Path != "/index.html" || request.Query != "a=1" {
+		t.Fatalf("wrong uri %v %v", request.Path, request.Query)
+	}
+}
+
+func TestRequestIpv6(t *testing.T) {
+	r := runRecord(t, "request_ipv6")
+	request := r.(core.HttpRequest)
+	if request.HttpIpAndPort.DstIP != "2001:db8::1" || request.HttpIpAndPort.DstPort != 8080 {
+		t.Fatalf("wrong destination %+v", request.HttpIpAndPort)
+	}
+	if request.HttpIpAndPort.SrcIP != "2001:db8::2" || request.HttpIpAndPort.SrcPort != 51000 || request.HttpIpAndPort.ConnectionID != "7" {
+		t.Fatalf("wrong source %+v", request.HttpIpAndPort)
+	}
 }
 
 func TestResponse(t *testing.T) {
 	r := runRecord(t, "response")
 	response := r.(core.HttpResponse)
-	if response.Code != 200 {
-		t.Fatalf("wrong code %v", response.Code)
+	if response.Code != 200 || response.StatusText != "OK" {
+		t.Fatalf("wrong status %v %v", response.Code, response.StatusText)
+	}
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	records := runRecords(t, "pipelined_requests")
+	if len(records) != 2 {
+		t.Fatalf("expected 2 requests, but got %+v", records)
+	}
+	first := records[0].(core.HttpRequest)
+	second := records[1].(core.HttpRequest)
+	if first.Method != "GET" || first.Path != "http://example.com/first" || first.PairedFrame != 7 ||
+		strings.Join(first.Headers, "|") != "Host: example.com|Accept: */*" {
+		t.Fatalf("wrong first request %+v", first)
+	}
+	if second.Method != "POST" || second.Path != "http://example.com/second" || second.Query != "a=1" || second.PairedFrame != 8 ||
+		strings.Join(second.Headers, "|") != "Host: example.com|Content-Length: 2" {
+		t.Fatalf("wrong second request %+v", second)
+	}
+	// the single body cannot be attributed to one of the requests
+	if first.Data != "" || second.Data != "" {
+		t.Fatalf("unattributed body should be dropped %q %q", first.Data, second.Data)
+	}
+}
+
+func TestPipelinedResponses(t *testing.T) {
+	records := runRecords(t, "pipelined_responses")
+	if len(records) != 2 {
+		t.Fatalf("expected 2 responses, but got %+v", records)
+	}
+	first := records[0].(core.HttpResponse)
+	second := records[1].(core.HttpResponse)
+	if first.Code != 200 || first.StatusText != "OK" || first.Data != "first" ||
+		strings.Join(first.Headers, "|") != "Server: ECS|Content-Length: 5" {
+		t.Fatalf("wrong first response %+v", first)
+	}
+	if second.Code != 404 || second.StatusText != "Not Found" || second.Data != "second" ||
+		strings.Join(second.Headers, "|") != "Server: ECS|Set-Cookie: a=1|Content-Length: 6" {
+		t.Fatalf("wrong second response %+v", second)
+	}
+}
+
+func TestUnsplitHeaderLines(t *testing.T) {
+	// the first header is repeated within a message
+	lines := []string{"Set-Cookie: a=1\r\n", "Set-Cookie: b=2\r\n", "Server: ECS\r\n", "Set-Cookie: c=3\r\n"}
+	messages := splitHeaderLines(lines, 2)
+	if len(messages[0]) != 4 || len(messages[1]) != 0 {
+		t.Fatalf("lines that cannot be split should be kept in the first message %q", messages)
 	}
 }
 
 func runRecord(t *testing.T, name string) interface{} {
+	parsed := runRecords(t, name)
+	if len(parsed) != 1 {
+		t.Fatalf("expected one item, but got %v", len(parsed))
+	}
+
+	fmt.Printf("%+v\n", parsed[0])
+	return parsed[0]
+}
+
+func runRecords(t *testing.T, name string) []interface{} {
 	core.Config.Verbose = 5
 	data := getTestData(t, name)
 
 	var parsed []interface{}
 
 	p := Processor{
+		Logger: logrus.New(),
 		HttpProcessor: func(i interface{}) {
 			parsed = append(parsed, i)
 		},
@@ -43,13 +120,7 @@ func runRecord(t *testing.T, name string) interface{} {
 	p.Start()
 	p.Queue(data)
 	p.Stop()
-
-	if len(parsed) != 1 {
-		t.Fatalf("expected one item, but got %v", len(parsed))
-	}
-
-	fmt.Printf("%+v\n", parsed[0])
-	return parsed[0]
+	return parsed
 }
 
 func getTestData(t *testing.T, name string) string {
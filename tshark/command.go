@@ -8,7 +8,10 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -19,18 +22,40 @@ const WARNING = "WARNING"
 type CommandLine struct {
 	Processor LineProcessor
 	Logger    *logrus.Logger
+	cmd       *exec.Cmd
+	streams   sync.WaitGroup
+	stats     map[string]core.CaptureStats
+	mutex     sync.Mutex
+	stopping  bool
+	exited    chan bool
 }
 
 func (c *CommandLine) Start() error {
-	args := fmt.Sprintf("sudo dumpcap -i %v -f '%v' -B %v -w - | sudo tshark -r - -Y http -T json",
-		core.Config.Device,
-		c.getFilter(),
-		core.Config.DumpCapBufferSize)
+	var args string
+	if core.Config.PcapFile == "" {
+		// the capture filter and buffer size apply to the interface that precedes them
+		var interfaces []string
+		for _, device := range core.Devices() {
+			interfaces = append(interfaces, fmt.Sprintf("-i %v -f %v -B %v", shellQuote(device), shellQuote(c.getFilter()), core.Config.DumpCapBufferSize))
+		}
+		args = fmt.Sprintf("sudo dumpcap %v -w - | sudo tshark -r - -Y http -T json", strings.Join(interfaces, " "))
+	} else {
+		// capture filters cannot be used on a file, so the hosts are filtered by the display filter
+		args = fmt.Sprintf("tshark -r %v -Y %v -T json",
+			shellQuote(core.Config.PcapFile),
+			shellQuote(c.getDisplayFilter()))
+	}
 
+	args += c.getTLSOptions()
+	args += " -e ip.src"
+	args += " -e ipv6.src"
+	args += " -e tcp.srcport"
 	args += " -e ip.dst"
+	args += " -e ipv6.dst"
 	args += " -e tcp.dstport"
 	args += " -e tcp.stream"
 	args += " -e frame.time_epoch"
+	args += " -e frame.number"
 	args += " -e http.request"
 	args += " -e http.request.method"
 	args += " -e http.request.version"
@@ -41,10 +66,16 @@ func (c *CommandLine) Start() error {
 	args += " -e http.response"
 	args += " -e http.response.version"
 	args += " -e http.response.code"
+	args += " -e http.response.phrase"
 	args += " -e http.response.line"
+	args += " -e http.request_in"
+	args += " -e http.response_in"
 
 	c.Logger.Info(fmt.Sprintf("running command: %v", args))
 	cmd := exec.Command("sh", "-c", args)
+	// run the pipeline in its own process group, so it can be terminated as a whole
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	c.cmd = cmd
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
 		return fmt.Errorf("get command stderr failed: %v", err)
@@ -60,42 +91,203 @@ func (c *CommandLine) Start() error {
 		return fmt.Errorf("start command failed: %v", err)
 	}
 
+	c.exited = make(chan bool)
+	c.streams.Add(2)
 	go c.streamRead(stderr, false)
 	go c.streamRead(stdout, true)
+	go c.wait()
 
 	return nil
 }
 
+// Stats returns the last packets drop report of each interface.
+// Notice that dumpcap prints the report only when it terminates.
+func (c *CommandLine) Stats() []core.CaptureStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var stats []core.CaptureStats
+	for _, interfaceStats := range c.stats {
+		stats = append(stats, interfaceStats)
+	}
+	return stats
+}
+
+// Wait blocks until the command output is fully read.
+// A live capture ends only when the command is stopped.
+func (c *CommandLine) Wait() {
+	<-c.exited
+}
+
+// Stop terminates the command, and waits until the output that it already produced is read
+func (c *CommandLine) Stop() {
+	c.mutex.Lock()
+	c.stopping = true
+	c.mutex.Unlock()
+
+	select {
+	case <-c.exited:
+		return
+	default:
+	}
+
+	err := syscall.Kill(-c.cmd.Process.Pid, syscall.SIGTERM)
+	if err != nil {
+		c.Logger.Warn(fmt.Sprintf("terminate command failed: %v", err))
+	}
+	c.Wait()
+}
+
+func (c *CommandLine) isStopping() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stopping
+}
+
+func (c *CommandLine) wait() {
+	c.streams.Wait()
+	err := c.cmd.Wait()
+	if err != nil && !c.isStopping() {
+		c.Logger.Warn(fmt.Sprintf("command completed with error: %v", err))
+	}
+	close(c.exited)
+}
+
+// decrypt the TLS hosts using the key log, and decode their ports as TLS
+func (c *CommandLine) getTLSOptions() string {
+	tlsHosts := core.TLSHosts()
+	if tlsHosts == nil {
+		return ""
+	}
+
+	options := fmt.Sprintf(" -o %v", shellQuote("tls.keylog_file:"+core.Config.TLSKeyLog))
+	for _, host := range tlsHosts.GetIncluded() {
+		if host.IsPortRange() {
+			options += fmt.Sprintf(" -d tcp.port==%v-%v,tls", host.Port, host.PortEnd)
+		} else if host.Port != 0 {
+			options += fmt.Sprintf(" -d tcp.port==%v,tls", host.Port)
+		}
+	}
+	return options
+}
+
+// shellQuote returns the value as a single argument of the shell command line.
+// The value is single quoted, so only its own single quotes need escaping.
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
 // build the BPF
 func (c *CommandLine) getFilter() string {
-	bpf := ""
-	hosts := core.ProduceHosts(core.Config.Hosts).GetHosts()
-	if len(hosts) == 1 {
-		bpf = "tcp && (" + c.GetHostFilter(hosts[0]) + ")"
-	} else {
-		var filters []string
-		for i := 0; i < len(hosts); i++ {
-			filters = append(filters, c.GetHostFilter(hosts[i]))
-		}
+	hosts := core.CapturedHosts()
+	var filters []string
+	for _, host := range hosts.GetIncluded() {
+		filters = append(filters, c.GetHostFilter(host))
+	}
+	bpf := "tcp"
+	if len(filters) > 0 {
 		bpf = fmt.Sprintf("tcp && (%v)", strings.Join(filters, " || "))
 	}
+
+	var excluded []string
+	for _, host := range hosts.GetExcluded() {
+		excluded = append(excluded, c.GetHostFilter(host))
+	}
+	if len(excluded) > 0 {
+		bpf = fmt.Sprintf("%v && !(%v)", bpf, strings.Join(excluded, " || "))
+	}
 	return bpf
 }
 
 func (c *CommandLine) GetHostFilter(host core.Host) string {
+	ports := ""
+	if host.IsPortRange() {
+		ports = fmt.Sprintf("portrange %v-%v", host.Port, host.PortEnd)
+	} else if host.Port != 0 {
+		ports = fmt.Sprintf("port %v", host.Port)
+	}
 	if len(host.Ip) == 0 {
-		return fmt.Sprintf("port %v", host.Port)
+		if ports == "" {
+			return "tcp"
+		}
+		return ports
 	}
+
+	family := ""
+	if host.IsIPv6() {
+		family = "ip6 "
+	}
+	kind := "host"
+	if host.IsNetwork() {
+		kind = "net"
+	}
+	if ports == "" {
+		return fmt.Sprintf("(%v%v %v)", family, kind, host.Ip)
+	}
+
 	if core.Config.BPFType == "strict" {
-		return fmt.Sprintf("(src port %v && src host %v) || (dst port %v && dst host %v)", host.Port, host.Ip, host.Port, host.Ip)
+		return fmt.Sprintf("(src %v && %vsrc %v %v) || (dst %v && %vdst %v %v)", ports, family, kind, host.Ip, ports, family, kind, host.Ip)
 	} else if core.Config.BPFType == "not-strict" {
-		return fmt.Sprintf("(port %v && host %v)", host.Port, host.Ip)
+		return fmt.Sprintf("(%v && %v%v %v)", ports, family, kind, host.Ip)
 	} else {
 		panic(fmt.Sprintf("Unsupported BPFType %v. Only strict and not-strict BPF types are supported.", core.Config.BPFType))
 	}
 
 }
 
+// build the display filter, used instead of the BPF when reading a file
+func (c *CommandLine) getDisplayFilter() string {
+	hosts := core.CapturedHosts()
+	var filters []string
+	for _, host := range hosts.GetIncluded() {
+		filters = append(filters, c.GetHostDisplayFilter(host))
+	}
+	displayFilter := "http"
+	if len(filters) > 0 {
+		displayFilter = fmt.Sprintf("http && (%v)", strings.Join(filters, " || "))
+	}
+
+	var excluded []string
+	for _, host := range hosts.GetExcluded() {
+		excluded = append(excluded, c.GetHostDisplayFilter(host))
+	}
+	if len(excluded) > 0 {
+		displayFilter = fmt.Sprintf("%v && !(%v)", displayFilter, strings.Join(excluded, " || "))
+	}
+	return displayFilter
+}
+
+func (c *CommandLine) GetHostDisplayFilter(host core.Host) string {
+	portField := func(field string) string {
+		if host.IsPortRange() {
+			return fmt.Sprintf("%v in {%v..%v}", field, host.Port, host.PortEnd)
+		}
+		return fmt.Sprintf("%v == %v", field, host.Port)
+	}
+
+	ipField := "ip"
+	if host.IsIPv6() {
+		ipField = "ipv6"
+	}
+	if len(host.Ip) == 0 {
+		if host.Port == 0 {
+			return "tcp"
+		}
+		return portField("tcp.port")
+	}
+	if host.Port == 0 {
+		return fmt.Sprintf("%v.addr == %v", ipField, host.Ip)
+	}
+
+	if core.Config.BPFType == "strict" {
+		return fmt.Sprintf("(%v && %v.src == %v) || (%v && %v.dst == %v)", portField("tcp.srcport"), ipField, host.Ip, portField("tcp.dstport"), ipField, host.Ip)
+	} else if core.Config.BPFType == "not-strict" {
+		return fmt.Sprintf("(%v && %v.addr == %v)", portField("tcp.port"), ipField, host.Ip)
+	} else {
+		panic(fmt.Sprintf("Unsupported BPFType %v. Only strict and not-strict BPF types are supported.", core.Config.BPFType))
+	}
+}
+
 func (c *CommandLine) getPortsFilter() string {
 	if len(core.Config.Hosts) == 0 {
 		return ""
@@ -124,10 +316,58 @@ func (c *CommandLine) persistDroppedPacketsPct(packetDropReport string) {
 	}
 	c.Logger.Info(fmt.Sprintf("Managed to persist dumpcap report -> %v", packetDropReport))
 }
+func (c *CommandLine) updateStats(packetDropReport string) {
+	stats := ParsePacketDropReport(packetDropReport)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.stats == nil {
+		c.stats = make(map[string]core.CaptureStats)
+	}
+	c.stats[stats.Interface] = stats
+}
+
+// ParsePacketDropReport parses the dumpcap packets drop report, for example:
+// Packets received/dropped on interface 'eno2': 7467018/3189 (pcap:3189/dumpcap:0/flushed:0/ps_ifdrop:0) (100.0%)
+func ParsePacketDropReport(packetDropReport string) core.CaptureStats {
+	stats := core.CaptureStats{}
+	nameStart := strings.Index(packetDropReport, "'")
+	nameEnd := strings.LastIndex(packetDropReport, "'")
+	if nameStart == -1 || nameEnd <= nameStart {
+		return stats
+	}
+	stats.Interface = packetDropReport[nameStart+1 : nameEnd]
+
+	counters := packetDropReport[nameEnd+1:]
+	leftIdx := strings.Index(counters, ":") + 1
+	rightIdx := strings.Index(counters, "(")
+	if rightIdx < leftIdx {
+		return stats
+	}
+	sections := strings.Split(strings.TrimSpace(counters[leftIdx:rightIdx]), "/")
+	if len(sections) != 2 {
+		return stats
+	}
+	stats.Received, _ = strconv.ParseUint(sections[0], 10, 64)
+	stats.Dropped, _ = strconv.ParseUint(sections[1], 10, 64)
+
+	ifDropIdx := strings.Index(counters, "ps_ifdrop:")
+	if ifDropIdx != -1 {
+		ifDrop := counters[ifDropIdx+len("ps_ifdrop:"):]
+		ifDrop = ifDrop[:strings.IndexAny(ifDrop+")", "/)")]
+		stats.IfDropped, _ = strconv.ParseUint(ifDrop, 10, 64)
+	}
+	return stats
+}
+
 func (c *CommandLine) streamRead(stream io.ReadCloser, collectJson bool) {
+	defer c.streams.Done()
 	reader := bufio.NewReader(stream)
 	for {
 		line, err := reader.ReadString('\n')
+		if err == io.EOF && (core.Config.PcapFile != "" || c.isStopping()) {
+			c.Logger.Info(fmt.Sprintf("command output completed, collect json: %v", collectJson))
+			return
+		}
 		if err != nil {
 			c.Logger.Fatal(fmt.Sprintf("read command output failed: %v", err))
 			if collectJson {
@@ -147,6 +387,7 @@ func (c *CommandLine) streamRead(stream io.ReadCloser, collectJson bool) {
 				c.Logger.Warn(fmt.Sprintf("Error stream: %v", line))
 				if packetDropMsg {
 					c.persistDroppedPacketsPct(line)
+					c.updateStats(line)
 				}
 			}
 		}
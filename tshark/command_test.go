@@ -0,0 +1,25 @@
+package tshark
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	values := []string{
+		"capture.pcap",
+		"/tmp/my captures/it's here.pcap",
+		"x'; touch /tmp/injected; echo '",
+		"tcp && (host 10.0.0.1 || port 80)",
+		"$(id) `id` \"quoted\" \\",
+	}
+	for _, value := range values {
+		output, err := exec.Command("sh", "-c", "printf %s "+shellQuote(value)).Output()
+		if err != nil {
+			t.Fatalf("run quoted %q failed: %v", value, err)
+		}
+		if string(output) != value {
+			t.Fatalf("expected the argument %q, but got %q", value, output)
+		}
+	}
+}
@@ -10,9 +10,12 @@ import (
 
 type TransactionProcessor func(core.HttpTransaction)
 
+// a stream with more pending requests is probably missing its responses
+const maxPendingRequests = 100
+
 type Processor struct {
 	entries     chan interface{}
-	requests    map[int]core.HttpRequest
+	requests    map[int][]core.HttpRequest
 	Processor   TransactionProcessor
 	mutex       sync.Mutex
 	ticker      *time.Ticker
@@ -20,12 +23,21 @@ type Processor struct {
 	stopChannel chan bool
 	stopped     bool
 	Logger      *logrus.Logger
+	captureTime time.Time
+	lastCheck   time.Time
+	evicted     uint64
+	orphaned    uint64
+	flushed     int
+
+	// the counters at the last report
+	reportedEvicted  uint64
+	reportedOrphaned uint64
 }
 
 func (p *Processor) Start() {
 	p.stopped = false
 	p.stopChannel = make(chan bool)
-	p.requests = make(map[int]core.HttpRequest)
+	p.requests = make(map[int][]core.HttpRequest)
 	p.entries = make(chan interface{}, core.Config.ChannelBuffer)
 	p.ticker = time.NewTicker(core.Config.ResponseCheckInterval)
 	p.waitGroup.Add(1)
@@ -53,6 +65,11 @@ func (p *Processor) correlate() {
 			break
 		case <-p.stopChannel:
 			p.Logger.Debug(fmt.Sprintf("correlator processor stopping"))
+			for len(p.entries) > 0 {
+				entry := <-p.entries
+				p.updateEntry(&entry)
+			}
+			p.expireAll()
 			p.stopped = true
 			break
 		}
@@ -63,12 +80,14 @@ func (p *Processor) correlate() {
 func (p *Processor) updateEntry(entry *interface{}) {
 	request, ok := (*entry).(core.HttpRequest)
 	if ok {
+		p.updateCaptureTime(request.Time)
 		p.updateRequest(&request)
 		return
 	}
 
 	response, ok := (*entry).(core.HttpResponse)
 	if ok {
+		p.updateCaptureTime(response.Time)
 		p.updateResponse(&response)
 		return
 	}
@@ -76,32 +95,132 @@ func (p *Processor) updateEntry(entry *interface{}) {
 	p.Logger.Fatal(fmt.Sprintf("invalid entry %+v", entry))
 }
 
+// keep the outstanding requests in the order they were sent, as HTTP/1.1 responses are sent in the same order
 func (p *Processor) updateRequest(request *core.HttpRequest) {
 	p.mutex.Lock()
-	p.requests[request.Stream] = *request
-	p.mutex.Unlock()
+	defer p.mutex.Unlock()
+
+	pending := append(p.requests[request.Stream], *request)
+	if len(pending) > maxPendingRequests {
+		p.evicted++
+		p.Logger.Debug(fmt.Sprintf("stream %v has too many pending requests, sending the oldest without a response", request.Stream))
+		p.Processor(core.HttpTransaction{Request: pending[0]})
+		pending = pending[1:]
+	}
+	p.requests[request.Stream] = pending
 }
 
 func (p *Processor) updateResponse(response *core.HttpResponse) {
 	p.mutex.Lock()
-	request, exists := p.requests[response.Stream]
-	p.mutex.Unlock()
-
-	if !exists {
+	pending := p.requests[response.Stream]
+	index := matchRequest(pending, response)
+	if index == -1 {
+		p.orphaned++
+		p.mutex.Unlock()
 		p.Logger.Trace(fmt.Sprintf("got response without request %+v", response))
 		return
 	}
 
+	// the requests before the matched request will not get a response
+	unanswered := pending[:index]
+	request := pending[index]
+	pending = pending[index+1:]
+	if len(pending) == 0 {
+		delete(p.requests, response.Stream)
+	} else {
+		p.requests[response.Stream] = pending
+	}
+	p.mutex.Unlock()
+
+	for _, unansweredRequest := range unanswered {
+		p.Processor(core.HttpTransaction{Request: unansweredRequest})
+	}
 	transaction := core.HttpTransaction{
 		Request:  request,
 		Response: response,
 	}
+	p.Processor(transaction)
+}
+
+// matchRequest returns the index of the request of the response, or -1 if it has no pending request.
+// The tshark frame references are used when available, and otherwise the oldest request without a reference is matched.
+// A response whose reference does not match a pending request is not matched, rather than paired with the wrong request.
+func matchRequest(pending []core.HttpRequest, response *core.HttpResponse) int {
+	for i, request := range pending {
+		if response.PairedFrame != 0 && response.PairedFrame == request.Frame {
+			return i
+		}
+		if response.Frame != 0 && request.PairedFrame == response.Frame {
+			return i
+		}
+	}
+	if response.PairedFrame != 0 {
+		return -1
+	}
+	for i, request := range pending {
+		if request.PairedFrame == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// when reading from a file, the time is driven by the captured packets time
+func (p *Processor) updateCaptureTime(entryTime *time.Time) {
+	if core.Config.PcapFile == "" || entryTime == nil {
+		return
+	}
 
+	if entryTime.After(p.captureTime) {
+		p.captureTime = *entryTime
+	}
+	if p.lastCheck.IsZero() {
+		p.lastCheck = p.captureTime
+	}
+	if p.captureTime.Sub(p.lastCheck) >= core.Config.ResponseCheckInterval {
+		p.checkTimeouts()
+		p.lastCheck = p.captureTime
+	}
+}
+
+func (p *Processor) now() time.Time {
+	if core.Config.PcapFile == "" {
+		return time.Now()
+	}
+	return p.captureTime
+}
+
+// send all requests that are still waiting for a response as transactions without a response
+func (p *Processor) expireAll() {
 	p.mutex.Lock()
-	delete(p.requests, response.Stream)
-	p.mutex.Unlock()
+	defer p.mutex.Unlock()
 
-	p.Processor(transaction)
+	count := 0
+	for stream, pending := range p.requests {
+		delete(p.requests, stream)
+		for _, request := range pending {
+			count++
+			p.Processor(core.HttpTransaction{Request: request})
+		}
+	}
+	p.flushed += count
+	if count > 0 {
+		p.Logger.Info(fmt.Sprintf("%v requests without response flushed", count))
+	}
+	p.reportCounters()
+}
+
+// reportCounters logs the evicted requests and the dropped responses since the previous report
+func (p *Processor) reportCounters() {
+	evicted := p.evicted - p.reportedEvicted
+	orphaned := p.orphaned - p.reportedOrphaned
+	if evicted == 0 && orphaned == 0 {
+		return
+	}
+	p.reportedEvicted = p.evicted
+	p.reportedOrphaned = p.orphaned
+	p.Logger.Info(fmt.Sprintf("%v requests sent without response from streams with too many pending requests, %v responses without request dropped",
+		evicted, orphaned))
 }
 
 func (p *Processor) checkTimeouts() {
@@ -109,12 +228,23 @@ func (p *Processor) checkTimeouts() {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
-	now := time.Now()
-	var expired []int
-	for stream, request := range p.requests {
-		passed := now.Sub(*request.Time)
-		if passed > core.Config.ResponseTimeout {
-			expired = append(expired, stream)
+	p.reportCounters()
+
+	now := p.now()
+	var expired []core.HttpRequest
+	for stream, pending := range p.requests {
+		var active []core.HttpRequest
+		for _, request := range pending {
+			if now.Sub(*request.Time) > core.Config.ResponseTimeout {
+				expired = append(expired, request)
+			} else {
+				active = append(active, request)
+			}
+		}
+		if len(active) == 0 {
+			delete(p.requests, stream)
+		} else {
+			p.requests[stream] = active
 		}
 	}
 
@@ -123,11 +253,15 @@ func (p *Processor) checkTimeouts() {
 	}
 
 	p.Logger.Debug(fmt.Sprintf("%v expired requests located", len(expired)))
-	for i := 0; i < len(expired); i++ {
-		stream := expired[i]
-		request := p.requests[stream]
-		delete(p.requests, stream)
+	for _, request := range expired {
 		transaction := core.HttpTransaction{Request: request}
 		p.Processor(transaction)
 	}
 }
+
+// Flushed returns the number of requests that were still waiting for a response when the processor stopped
+func (p *Processor) Flushed() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.flushed
+}
@@ -3,13 +3,16 @@ package correlator
 import (
 	"fmt"
 	"github.com/alonana/httshark/core"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"strings"
 	"testing"
 	"time"
 )
 
 func TestEmpty(t *testing.T) {
 	core.Config.ResponseCheckInterval = time.Second
-	p := Processor{}
+	p := Processor{Logger: logrus.New()}
 	p.Start()
 	p.Stop()
 }
@@ -20,6 +23,7 @@ func TestTransaction(t *testing.T) {
 
 	var transactions []core.HttpTransaction
 	p := Processor{
+		Logger: logrus.New(),
 		Processor: func(transaction core.HttpTransaction) {
 			transactions = append(transactions, transaction)
 		},
@@ -73,6 +77,7 @@ func TestExpired(t *testing.T) {
 
 	var transactions []core.HttpTransaction
 	p := Processor{
+		Logger: logrus.New(),
 		Processor: func(transaction core.HttpTransaction) {
 			transactions = append(transactions, transaction)
 		},
@@ -109,3 +114,227 @@ func TestExpired(t *testing.T) {
 		t.Fatalf("response should be empty")
 	}
 }
+
+func TestCaptureTimeExpired(t *testing.T) {
+	core.Config.PcapFile = "test.pcap"
+	defer func() { core.Config.PcapFile = "" }()
+	core.Config.ResponseCheckInterval = time.Second
+	core.Config.ResponseTimeout = time.Minute
+
+	var transactions []core.HttpTransaction
+	p := Processor{
+		Logger: logrus.New(),
+		Processor: func(transaction core.HttpTransaction) {
+			transactions = append(transactions, transaction)
+		},
+	}
+	p.Start()
+
+	requestTime := time.Unix(1586165861, 0)
+	stream := 123
+	request := core.HttpRequest{
+		HttpEntry: core.HttpEntry{
+			Time:   &requestTime,
+			Stream: stream,
+		},
+		Method: "GET",
+		Path:   "/",
+	}
+	p.Queue(request)
+
+	// the response arrives after the timeout, by the capture time
+	responseTime := requestTime.Add(2 * time.Minute)
+	response := core.HttpResponse{
+		HttpEntry: core.HttpEntry{
+			Time:   &responseTime,
+			Stream: stream,
+		},
+		Code: 200,
+	}
+	p.Queue(response)
+	p.Stop()
+
+	if len(transactions) != 1 {
+		t.Fatalf("expected one item, but got %v", len(transactions))
+	}
+
+	if transactions[0].Response != nil {
+		t.Fatalf("response should be empty")
+	}
+}
+
+func pipelinedRequest(now *time.Time, stream int, frame int, path string) core.HttpRequest {
+	return core.HttpRequest{
+		HttpEntry: core.HttpEntry{
+			Time:   now,
+			Stream: stream,
+			Frame:  frame,
+		},
+		Method: "GET",
+		Path:   path,
+	}
+}
+
+func pipelinedResponse(now *time.Time, stream int, frame int, requestFrame int, code int) core.HttpResponse {
+	return core.HttpResponse{
+		HttpEntry: core.HttpEntry{
+			Time:        now,
+			Stream:      stream,
+			Frame:       frame,
+			PairedFrame: requestFrame,
+		},
+		Code: code,
+	}
+}
+
+func TestPipelining(t *testing.T) {
+	core.Config.ResponseCheckInterval = time.Second
+	core.Config.ResponseTimeout = time.Minute
+
+	var transactions []core.HttpTransaction
+	p := Processor{
+		Logger: logrus.New(),
+		Processor: func(transaction core.HttpTransaction) {
+			transactions = append(transactions, transaction)
+		},
+	}
+	p.Start()
+
+	now := time.Now()
+	p.Queue(pipelinedRequest(&now, 1, 1, "/first"))
+	p.Queue(pipelinedRequest(&now, 1, 2, "/second"))
+	p.Queue(pipelinedResponse(&now, 1, 3, 0, 200))
+	p.Queue(pipelinedResponse(&now, 1, 4, 0, 201))
+	p.Queue(pipelinedResponse(&now, 1, 5, 0, 202))
+	p.Stop()
+
+	if len(transactions) != 2 {
+		t.Fatalf("expected 2 transactions, but got %+v", transactions)
+	}
+	if transactions[0].Request.Path != "/first" || transactions[0].Response.Code != 200 ||
+		transactions[1].Request.Path != "/second" || transactions[1].Response.Code != 201 {
+		t.Fatalf("wrong pipelined transactions %+v", transactions)
+	}
+	if p.evicted != 0 || p.orphaned != 1 {
+		t.Fatalf("wrong counters evicted %v orphaned %v", p.evicted, p.orphaned)
+	}
+}
+
+func TestFrameReferences(t *testing.T) {
+	core.Config.ResponseCheckInterval = time.Second
+	core.Config.ResponseTimeout = time.Minute
+
+	var transactions []core.HttpTransaction
+	p := Processor{
+		Logger: logrus.New(),
+		Processor: func(transaction core.HttpTransaction) {
+			transactions = append(transactions, transaction)
+		},
+	}
+	p.Start()
+
+	now := time.Now()
+	p.Queue(pipelinedRequest(&now, 1, 10, "/lost"))
+	p.Queue(pipelinedRequest(&now, 1, 11, "/answered"))
+	// the response of the first request was not captured
+	p.Queue(pipelinedResponse(&now, 1, 12, 11, 200))
+	p.Stop()
+
+	if len(transactions) != 2 {
+		t.Fatalf("expected 2 transactions, but got %+v", transactions)
+	}
+	if transactions[0].Request.Path != "/lost" || transactions[0].Response != nil {
+		t.Fatalf("wrong unanswered transaction %+v", transactions[0])
+	}
+	if transactions[1].Request.Path != "/answered" || transactions[1].Response == nil {
+		t.Fatalf("wrong answered transaction %+v", transactions[1])
+	}
+}
+
+func TestUnmatchedFrameReference(t *testing.T) {
+	core.Config.ResponseCheckInterval = time.Second
+	core.Config.ResponseTimeout = time.Minute
+
+	var transactions []core.HttpTransaction
+	p := Processor{
+		Logger: logrus.New(),
+		Processor: func(transaction core.HttpTransaction) {
+			transactions = append(transactions, transaction)
+		},
+	}
+	p.Start()
+
+	now := time.Now()
+	p.Queue(pipelinedRequest(&now, 1, 10, "/pending"))
+	// the request of the response was not captured
+	p.Queue(pipelinedResponse(&now, 1, 12, 11, 200))
+	p.Stop()
+
+	if len(transactions) != 1 || transactions[0].Request.Path != "/pending" || transactions[0].Response != nil {
+		t.Fatalf("the response should not be paired with another request %+v", transactions)
+	}
+	if p.orphaned != 1 {
+		t.Fatalf("expected 1 orphaned response, but got %v", p.orphaned)
+	}
+}
+
+func TestFlushOnStop(t *testing.T) {
+	core.Config.ResponseCheckInterval = time.Second
+	core.Config.ResponseTimeout = time.Minute
+
+	var transactions []core.HttpTransaction
+	p := Processor{
+		Logger: logrus.New(),
+		Processor: func(transaction core.HttpTransaction) {
+			transactions = append(transactions, transaction)
+		},
+	}
+	p.Start()
+
+	now := time.Now()
+	p.Queue(pipelinedRequest(&now, 1, 1, "/pending"))
+	p.Stop()
+
+	if len(transactions) != 1 || transactions[0].Response != nil {
+		t.Fatalf("expected the pending request without response, but got %+v", transactions)
+	}
+	if p.Flushed() != 1 {
+		t.Fatalf("expected 1 flushed request, but got %v", p.Flushed())
+	}
+}
+
+func TestCountersReport(t *testing.T) {
+	core.Config.ResponseTimeout = time.Minute
+
+	logger, hook := test.NewNullLogger()
+	var transactions []core.HttpTransaction
+	p := Processor{
+		Logger:   logger,
+		requests: make(map[int][]core.HttpRequest),
+		Processor: func(transaction core.HttpTransaction) {
+			transactions = append(transactions, transaction)
+		},
+	}
+
+	now := time.Now()
+	for i := 0; i <= maxPendingRequests; i++ {
+		p.updateRequest(&core.HttpRequest{HttpEntry: core.HttpEntry{Time: &now, Stream: 1, Frame: i + 1}})
+	}
+	response := pipelinedResponse(&now, 2, 1000, 0, 200)
+	p.updateResponse(&response)
+	if len(transactions) != 1 || transactions[0].Request.Frame != 1 || transactions[0].Response != nil {
+		t.Fatalf("expected the oldest request to be sent without response, but got %+v", transactions)
+	}
+
+	// the counters are reported by the periodic timeouts check, and only when they changed
+	p.checkTimeouts()
+	if hook.LastEntry() == nil || !strings.HasPrefix(hook.LastEntry().Message, "1 requests sent without response") ||
+		!strings.Contains(hook.LastEntry().Message, "1 responses without request") {
+		t.Fatalf("wrong counters report %+v", hook.LastEntry())
+	}
+	hook.Reset()
+	p.checkTimeouts()
+	if len(hook.Entries) != 0 {
+		t.Fatalf("unchanged counters should not be reported %+v", hook.Entries)
+	}
+}
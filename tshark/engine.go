@@ -0,0 +1,73 @@
+package tshark
+
+import (
+	"fmt"
+	"github.com/alonana/httshark/core"
+	"github.com/alonana/httshark/tshark/bulk"
+	"github.com/alonana/httshark/tshark/correlator"
+	"github.com/alonana/httshark/tshark/line"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	core.RegisterCaptureEngine("tshark", func(logger *logrus.Logger) core.CaptureEngine {
+		return &Engine{Logger: logger}
+	})
+}
+
+// Engine runs the tshark command line, and produces the transactions using the line, bulk and correlator processors.
+type Engine struct {
+	Logger              *logrus.Logger
+	correlatorProcessor correlator.Processor
+	bulkProcessor       bulk.Processor
+	lineProcessor       line.Processor
+	command             CommandLine
+	done                chan bool
+}
+
+func (e *Engine) Start(processor core.TransactionProcessor) error {
+	e.done = make(chan bool)
+
+	e.correlatorProcessor = correlator.Processor{Processor: correlator.TransactionProcessor(processor), Logger: e.Logger}
+	e.correlatorProcessor.Start()
+
+	e.bulkProcessor = bulk.Processor{HttpProcessor: e.correlatorProcessor.Queue, Logger: e.Logger}
+	e.bulkProcessor.Start()
+
+	e.lineProcessor = line.Processor{BulkProcessor: e.bulkProcessor.Queue, Logger: e.Logger}
+	e.lineProcessor.Start()
+
+	e.command = CommandLine{
+		Processor: e.lineProcessor.Queue,
+		Logger:    e.Logger,
+	}
+	err := e.command.Start()
+	if err != nil {
+		return fmt.Errorf("start command failed: %v", err)
+	}
+
+	if core.Config.PcapFile != "" {
+		go func() {
+			e.command.Wait()
+			close(e.done)
+		}()
+	}
+	return nil
+}
+
+// Stop the command, and then the processors, in the order of the data flow, so each processor drains its input
+func (e *Engine) Stop() core.FlushStats {
+	e.command.Stop()
+	e.lineProcessor.Stop()
+	e.bulkProcessor.Stop()
+	e.correlatorProcessor.Stop()
+	return core.FlushStats{Requests: e.correlatorProcessor.Flushed()}
+}
+
+func (e *Engine) Stats() []core.CaptureStats {
+	return e.command.Stats()
+}
+
+func (e *Engine) Done() <-chan bool {
+	return e.done
+}
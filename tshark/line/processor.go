@@ -16,6 +16,8 @@ type Processor struct {
 	waitGroup     sync.WaitGroup
 	stopChannel   chan bool
 	stopped       bool
+	collect       bool
+	collected     []string
 	Logger        *logrus.Logger
 
 }
@@ -38,31 +40,36 @@ func (p *Processor) Queue(line string) {
 }
 
 func (p *Processor) aggregate() {
-	var lines []string
-	collect := false
 	for !p.stopped {
 		select {
 		case line := <-p.lines:
-			if line == "  {" {
-				collect = true
-			}
-			if collect {
-				lines = append(lines, strings.TrimSpace(line))
-			}
-			if line == "  }" {
-				data := strings.Join(lines, "")
-				p.Logger.Trace(fmt.Sprintf("json data is %v", data))
-				p.BulkProcessor(data)
-				lines = nil
-				collect = false
-			}
+			p.processLine(line)
 			break
 
 		case <-p.stopChannel:
 			p.Logger.Debug(fmt.Sprintf("stdout line processor stopping"))
+			for len(p.lines) > 0 {
+				p.processLine(<-p.lines)
+			}
 			p.stopped = true
 			break
 		}
 	}
 	p.waitGroup.Done()
 }
+
+func (p *Processor) processLine(line string) {
+	if line == "  {" {
+		p.collect = true
+	}
+	if p.collect {
+		p.collected = append(p.collected, strings.TrimSpace(line))
+	}
+	if line == "  }" {
+		data := strings.Join(p.collected, "")
+		p.Logger.Trace(fmt.Sprintf("json data is %v", data))
+		p.BulkProcessor(data)
+		p.collected = nil
+		p.collect = false
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/alonana/httshark/core"
+	"github.com/sirupsen/logrus"
 	"io/ioutil"
 	"strings"
 	"testing"
@@ -13,7 +14,7 @@ type DummyTestData struct {
 }
 
 func TestEmpty(t *testing.T) {
-	p := Processor{}
+	p := Processor{Logger: logrus.New()}
 	p.Start()
 	p.Stop()
 }
@@ -33,6 +34,7 @@ func runRecord(t *testing.T, name string) {
 	var parsed []string
 
 	p := Processor{
+		Logger: logrus.New(),
 		BulkProcessor: func(line string) {
 			parsed = append(parsed, line)
 		},
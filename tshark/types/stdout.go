@@ -9,21 +9,30 @@ type Source struct {
 }
 
 type Layers struct {
-	Time      []string `json:"frame.time_epoch"`
-	TcpStream []string `json:"tcp.stream"`
-	Data      []string `json:"http.file_data"`
+	Time        []string `json:"frame.time_epoch"`
+	FrameNumber []string `json:"frame.number"`
+	TcpStream   []string `json:"tcp.stream"`
+	Data        []string `json:"http.file_data"`
 
-	DstIp    []string `json:"ip.dst"`
-	DstPort  []string `json:"tcp.dstport"`
+	SrcIp   []string `json:"ip.src"`
+	SrcIpv6 []string `json:"ipv6.src"`
+	SrcPort []string `json:"tcp.srcport"`
+	DstIp   []string `json:"ip.dst"`
+	DstIpv6 []string `json:"ipv6.dst"`
+	DstPort []string `json:"tcp.dstport"`
 
 	IsRequest      []string `json:"http.request"`
 	RequestMethod  []string `json:"http.request.method"`
 	RequestVersion []string `json:"http.request.version"`
 	RequestLine    []string `json:"http.request.line"`
 	RequestUri     []string `json:"http.request.full_uri"`
+	RequestPath    []string `json:"http.request.uri"`
+	ResponseIn     []string `json:"http.response_in"`
 
 	IsResponse      []string `json:"http.response"`
 	ResponseVersion []string `json:"http.response.version"`
 	ResponseCode    []string `json:"http.response.code"`
+	ResponsePhrase  []string `json:"http.response.phrase"`
 	ResponseLine    []string `json:"http.response.line"`
+	RequestIn       []string `json:"http.request_in"`
 }
@@ -25,7 +25,7 @@ StopProcess() {
 
 RunProcess() {
   Message "RunProcess"
-  hosts=:54004,:54016,:54010,:54006,:54014,:54007,:50004,:54011,:50001,:54001,:50003,:54013,:54009,:50008,:54003,:54002,:54008,:54005,:50009,:54015,:50002,:50006,:54012,:54017,:54018,:50005,:50007,:50013,:50010,:50011,:50012,:50014,:50015
+  hosts=:54001-54018,:50001-50015
 
   echo "sudo ${PWD}/httshark -capture httpdump -device ${DEVICE} -output-folder ${PWD}/output -hosts ${hosts} -har-processors sites-stats -sites-stats-file ${PWD}/logs/sites.csv  >> ${PWD}/logs/httshark.log 2>&1" > /tmp/httshark.sh
   chmod +x /tmp/httshark.sh